@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envPrefix = "FRP_MULTIUSER_"
+
+// envName returns the environment variable for a flag, e.g. auth_file is
+// read from FRP_MULTIUSER_AUTH_FILE.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(flagName)
+}
+
+// parseEnvBool accepts the usual spellings of a boolean in the environment.
+func parseEnvBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean `%s`", value)
+	}
+}
+
+// applyEnv sets every flag which has a matching environment variable.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			var b bool
+			b, err = parseEnvBool(value)
+			if err != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), err)
+				return
+			}
+			value = fmt.Sprint(b)
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"frp-multiuser/lib"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvBool(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{value: "1", want: true},
+		{value: "true", want: true},
+		{value: " YES ", want: true},
+		{value: "On", want: true},
+		{value: "0"},
+		{value: "false"},
+		{value: "no"},
+		{value: "off"},
+		{value: ""},
+		{value: "2", wantErr: true},
+		{value: "enabled", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseEnvBool(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEnvBool(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseEnvBool(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte("log_level: warn\nrate_burst: 7\n"), 0600); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	tests := []struct {
+		name      string
+		config    string
+		env       map[string]string
+		args      []string
+		logLevel  string
+		rateBurst int
+		gzip      bool
+		wantErr   string
+	}{
+		{name: "defaults", logLevel: "info", rateBurst: 5},
+		{name: "config file", config: configFile, logLevel: "warn", rateBurst: 7},
+		{name: "config file from env", env: map[string]string{"FRP_MULTIUSER_CONFIG": configFile}, logLevel: "warn", rateBurst: 7},
+		{name: "env over config file", config: configFile, env: map[string]string{"FRP_MULTIUSER_LOG_LEVEL": "error", "FRP_MULTIUSER_GZIP": "yes"}, logLevel: "error", rateBurst: 7, gzip: true},
+		{name: "cli over env", config: configFile, env: map[string]string{"FRP_MULTIUSER_LOG_LEVEL": "error", "FRP_MULTIUSER_GZIP": "on"}, args: []string{"-log_level", "debug", "-gzip=false"}, logLevel: "debug", rateBurst: 7},
+		{name: "invalid env boolean", env: map[string]string{"FRP_MULTIUSER_GZIP": "maybe"}, wantErr: "FRP_MULTIUSER_GZIP: invalid boolean `maybe`"},
+		{name: "invalid env number", env: map[string]string{"FRP_MULTIUSER_RATE_BURST": "many"}, wantErr: "FRP_MULTIUSER_RATE_BURST"},
+		{name: "missing config file", config: filepath.Join(t.TempDir(), "missing.yaml"), wantErr: "load config file error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			var cfg lib.Config
+			fs := flag.NewFlagSet("frp-multiuser", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			fs.StringVar(&cfg.LogLevel, "log_level", "info", "")
+			fs.IntVar(&cfg.RateBurst, "rate_burst", 5, "")
+			fs.BoolVar(&cfg.Gzip, "gzip", false, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			err := loadConfig(fs, tt.args, tt.config, &cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if cfg.LogLevel != tt.logLevel || cfg.RateBurst != tt.rateBurst || cfg.Gzip != tt.gzip {
+				t.Errorf("log_level, rate_burst, gzip = %s, %d, %v, want %s, %d, %v", cfg.LogLevel, cfg.RateBurst, cfg.Gzip, tt.logLevel, tt.rateBurst, tt.gzip)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"frp-multiuser/lib"
+	"golang.org/x/term"
+	"os"
+	"strings"
+)
+
+// hashpw reads a password, from a prompt without echo when stdin is a
+// terminal and from the first line of stdin otherwise, and prints its hash
+// for the auth file.
+func hashpw(scheme string, cost int) error {
+	var password string
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		passwordBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		password = string(passwordBytes)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("read password error: %v", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return errors.New("password can not be empty")
+	}
+	hash, err := lib.HashPassword(password, scheme, cost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
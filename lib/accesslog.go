@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// responseWriter records the status and size of a response for the access
+// log.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+type accessInfoKey struct{}
+
+// accessInfo lets the handlers pass the user of a request to the access log.
+type accessInfo struct {
+	User string
+}
+
+// setAccessUser records the user of a request for the access log, if it is
+// enabled.
+func setAccessUser(r *http.Request, user string) {
+	if info, ok := r.Context().Value(accessInfoKey{}).(*accessInfo); ok {
+		info.User = user
+	}
+}
+
+// accessLog logs every request handled by next along with its status, size
+// and duration.
+func accessLog(next http.Handler, logger *slog.Logger, clientAddr func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &accessInfo{}
+		lw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), accessInfoKey{}, info)))
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		logger.Info("access",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", lw.status,
+			"bytes", lw.bytes,
+			"duration", time.Since(start),
+			"user", info.User,
+			"remote_addr", clientAddr(r),
+		)
+	})
+}
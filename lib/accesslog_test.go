@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// accessLines returns the lines of the log in buf containing marker.
+func accessLines(buf *bytes.Buffer, marker string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, marker) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestAccessLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestServer(t, Config{AuthData: "alice=x", AccessLog: true, Logger: slog.New(slog.NewJSONHandler(&buf, nil))})
+	w := postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`)
+	lines := accessLines(&buf, `"msg":"access"`)
+	if len(lines) != 1 {
+		t.Fatalf("%d access log lines, want 1 in %s", len(lines), buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("decode access log error = %v", err)
+	}
+	want := map[string]interface{}{
+		"level":       "INFO",
+		"method":      http.MethodPost,
+		"path":        "/handler",
+		"status":      float64(http.StatusOK),
+		"bytes":       float64(w.Body.Len()),
+		"user":        "alice",
+		"remote_addr": "203.0.113.1",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+	if duration, ok := entry["duration"].(float64); !ok || duration <= 0 {
+		t.Errorf("duration = %v, want a positive number", entry["duration"])
+	}
+}
+
+func TestAccessLogTextLine(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestServer(t, Config{AuthData: "alice=x", AccessLog: true, Logger: slog.New(slog.NewTextHandler(&buf, nil))})
+	postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"wrong"}}`)
+	lines := accessLines(&buf, "msg=access")
+	if len(lines) != 1 {
+		t.Fatalf("%d access log lines, want 1 in %s", len(lines), buf.String())
+	}
+	pattern := regexp.MustCompile(`^time=\S+ level=INFO msg=access method=POST path=/handler status=200 bytes=\d+ duration=\S+ user=alice remote_addr=203\.0\.113\.1$`)
+	if !pattern.MatchString(lines[0]) {
+		t.Errorf("access log line = %q, want it to match %s", lines[0], pattern)
+	}
+}
@@ -0,0 +1,238 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// adminUser is the body of POST /users. Password and Passwords may carry
+// inline policies, e.g. `secret;ports=8000`, as in the auth file.
+type adminUser struct {
+	Name      string   `json:"name"`
+	Password  string   `json:"password"`
+	Passwords []string `json:"passwords"`
+}
+
+// adminHandler serves the admin API, which manages the users of the auth
+// file at runtime:
+//
+//	GET    /users         list the user names
+//	POST   /users         create or update a user
+//	DELETE /users/{name}  delete a user
+//	POST   /reload        reload the users, as SIGHUP does
+//	POST   /promote       swap the staged auth file with the loaded one
+//	GET    /maintenance   maintenance mode state
+//	POST   /maintenance   turn maintenance mode on or off, {"enabled": true}
+//	GET    /stats         active proxies by user
+//
+// The /users endpoints need a single auth file.
+func (s *Server) adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkBearerToken(r, s.cfg.AdminToken) {
+			writeMsg(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if r.URL.Path == "/reload" {
+			s.handleAdminReload(w, r)
+			return
+		}
+		if r.URL.Path == "/maintenance" {
+			s.handleAdminMaintenance(w, r)
+			return
+		}
+		if r.URL.Path == "/promote" {
+			s.handleAdminPromote(w, r)
+			return
+		}
+		if r.URL.Path == "/stats" {
+			s.handleAdminStats(w, r)
+			return
+		}
+		m, ok := s.store.(*Map)
+		if !ok || len(m.Files()) != 1 {
+			if r.URL.Path == "/users" || strings.HasPrefix(r.URL.Path, "/users/") {
+				writeMsg(w, http.StatusNotImplemented, "users can only be managed with a single auth file")
+			} else {
+				writeMsg(w, http.StatusNotFound, "not found")
+			}
+			return
+		}
+		switch {
+		case r.URL.Path == "/users" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string][]string{"users": m.Users()})
+		case r.URL.Path == "/users" && r.Method == http.MethodPost:
+			s.handleAdminSaveUser(w, r, m)
+		case strings.HasPrefix(r.URL.Path, "/users/") && r.Method == http.MethodDelete:
+			s.handleAdminDeleteUser(w, strings.TrimPrefix(r.URL.Path, "/users/"), m)
+		case r.URL.Path == "/users":
+			w.Header().Set("Allow", "GET, POST")
+			writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		case strings.HasPrefix(r.URL.Path, "/users/"):
+			w.Header().Set("Allow", http.MethodDelete)
+			writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		default:
+			writeMsg(w, http.StatusNotFound, "not found")
+		}
+	})
+}
+
+func (s *Server) handleAdminSaveUser(w http.ResponseWriter, r *http.Request, m *Map) {
+	byteData, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, defaultMaxBodyBytes))
+	if err != nil {
+		writeMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var user adminUser
+	err = json.Unmarshal(byteData, &user)
+	if err != nil {
+		writeMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	user.Name = strings.TrimSpace(user.Name)
+	var entries []string
+	for _, entry := range append([]string{user.Password}, user.Passwords...) {
+		if strings.TrimSpace(entry) != "" {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	if user.Name == "" || strings.ContainsAny(user.Name, "=#\r\n") || len(entries) == 0 {
+		writeMsg(w, http.StatusBadRequest, "name and password are required")
+		return
+	}
+	for _, entry := range entries {
+		if strings.ContainsAny(entry, "\r\n") {
+			writeMsg(w, http.StatusBadRequest, "password can not contain line breaks")
+			return
+		}
+		password, _, err := parseAuthEntry(entry)
+		if err != nil {
+			writeMsg(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if password == "" {
+			writeMsg(w, http.StatusBadRequest, "name and password are required")
+			return
+		}
+	}
+	err = m.Update(func(AuthMap map[string][]string) error {
+		AuthMap[user.Name] = entries
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("save user error", "user", user.Name, "error", err)
+		writeMsg(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger.Info("user saved", "user", user.Name)
+	writeMsg(w, http.StatusOK, "ok")
+}
+
+func (s *Server) handleAdminDeleteUser(w http.ResponseWriter, name string, m *Map) {
+	err := m.Update(func(AuthMap map[string][]string) error {
+		found := false
+		for user := range AuthMap {
+			if user == name || (m.LowerUsers && strings.EqualFold(user, name)) {
+				delete(AuthMap, user)
+				found = true
+			}
+		}
+		if !found {
+			return errUserNotFound
+		}
+		return nil
+	})
+	if errors.Is(err, errUserNotFound) {
+		writeMsg(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, errEmptyAuthData) {
+		writeMsg(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error("delete user error", "user", name, "error", err)
+		writeMsg(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger.Info("user deleted", "user", name)
+	writeMsg(w, http.StatusOK, "ok")
+}
+
+// handleAdminReload reloads the store right away rather than through the
+// refresh channel, so that the response carries the outcome.
+func (s *Server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	err := s.reloadStore()
+	if errors.Is(err, errEmptyAuthData) {
+		writeMsg(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeMsg(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status := map[string]interface{}{
+		"status": "ok",
+	}
+	if uc, ok := s.store.(userCounter); ok {
+		status["users"] = uc.Len()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleAdminPromote promotes the staged auth file. The previous auth file
+// becomes the staged one, so promoting again rolls back.
+func (s *Server) handleAdminPromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	m, ok := s.store.(*Map)
+	if !ok {
+		writeMsg(w, http.StatusNotImplemented, errNoStagedFiles.Error())
+		return
+	}
+	err := m.Promote()
+	if errors.Is(err, errNoStagedFiles) {
+		writeMsg(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if errors.Is(err, errEmptyAuthData) {
+		writeMsg(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error("promote staged auth file error", "error", err)
+		writeMsg(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"auth_file": s.authFile(),
+		"users":     m.Len(),
+	})
+}
+
+// adminStats is the body of GET /stats.
+type adminStats struct {
+	Proxies map[string]int `json:"proxies"`
+}
+
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, adminStats{Proxies: s.proxies.Counts()})
+}
@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, s *Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminUsers(t *testing.T) {
+	filename := writeTestFile(t, "tokens", "# admins\nalice=x\n")
+	s := newTestServer(t, Config{AuthFile: filename, AdminAddr: "127.0.0.1:0", AdminToken: "admin"})
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("request without token status = %d, want 401", w.Code)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "add user", method: http.MethodPost, path: "/users", body: `{"name":"bob","password":"y;ports=8080"}`, status: http.StatusOK},
+		{name: "update user", method: http.MethodPost, path: "/users", body: `{"name":"alice","passwords":["x","x2"]}`, status: http.StatusOK},
+		{name: "missing password", method: http.MethodPost, path: "/users", body: `{"name":"carol"}`, status: http.StatusBadRequest},
+		{name: "invalid name", method: http.MethodPost, path: "/users", body: `{"name":"a=b","password":"z"}`, status: http.StatusBadRequest},
+		{name: "invalid policy", method: http.MethodPost, path: "/users", body: `{"name":"carol","password":"z;ports=abc"}`, status: http.StatusBadRequest},
+		{name: "line break", method: http.MethodPost, path: "/users", body: `{"name":"carol","password":"z\ndave=w"}`, status: http.StatusBadRequest},
+		{name: "malformed body", method: http.MethodPost, path: "/users", body: `{`, status: http.StatusBadRequest},
+		{name: "delete missing user", method: http.MethodDelete, path: "/users/carol", status: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodPut, path: "/users", status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := adminRequest(t, s, tt.method, tt.path, tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	w = adminRequest(t, s, http.MethodGet, "/users", "")
+	var users map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatalf("decode users error = %v", err)
+	}
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(users["users"], want) {
+		t.Errorf("users = %v, want %v", users["users"], want)
+	}
+	for _, tt := range []struct{ user, password string }{{"alice", "x"}, {"alice", "x2"}, {"bob", "y"}} {
+		if ok, _ := s.store.Verify(tt.user, tt.password); !ok {
+			t.Errorf("Verify(%s, %s) = false, want true", tt.user, tt.password)
+		}
+	}
+	if w := adminRequest(t, s, http.MethodDelete, "/users/bob", ""); w.Code != http.StatusOK {
+		t.Errorf("delete status = %d, want 200", w.Code)
+	}
+	if ok, _ := s.store.Verify("bob", "y"); ok {
+		t.Error("Verify(bob) = true after delete, want false")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("read error = %v", err)
+	}
+	if want := "# admins\nalice=x\nalice=x2\n"; string(data) != want {
+		t.Errorf("auth file = %q, want %q", data, want)
+	}
+	if w := adminRequest(t, s, http.MethodDelete, "/users/alice", ""); w.Code != http.StatusConflict {
+		t.Errorf("deleting the last user status = %d, want 409", w.Code)
+	}
+}
+
+func TestAdminUsersNeedSingleFile(t *testing.T) {
+	first := writeTestFile(t, "first", "alice=x\n")
+	second := writeTestFile(t, "second", "bob=y\n")
+	s := newTestServer(t, Config{AuthFile: first + "," + second, AdminAddr: "127.0.0.1:0", AdminToken: "admin"})
+	if w := adminRequest(t, s, http.MethodGet, "/users", ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want 501", w.Code)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	filename := writeTestFile(t, "tokens", "alice=x\n")
+	s := newTestServer(t, Config{AuthFile: filename, AdminAddr: "127.0.0.1:0", AdminToken: "admin"})
+
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		r := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		s.adminHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("reload with authorization %q status = %d, want 401", authorization, w.Code)
+		}
+	}
+	if w := adminRequest(t, s, http.MethodGet, "/reload", ""); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET /reload status = %d, Allow %q, want 405 and POST", w.Code, w.Header().Get("Allow"))
+	}
+
+	tests := []struct {
+		name   string
+		data   string
+		remove bool
+		status int
+		valid  string
+	}{
+		{name: "success", data: "alice=y\nbob=z\n", status: http.StatusOK, valid: "y"},
+		{name: "empty file", data: "", status: http.StatusConflict, valid: "y"},
+		{name: "missing file", remove: true, status: http.StatusInternalServerError, valid: "y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.remove {
+				err = os.Remove(filename)
+			} else {
+				err = os.WriteFile(filename, []byte(tt.data), 0600)
+			}
+			if err != nil {
+				t.Fatalf("change auth file error = %v", err)
+			}
+			w := adminRequest(t, s, http.MethodPost, "/reload", "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+			if ok, _ := s.store.Verify("alice", tt.valid); !ok {
+				t.Errorf("Verify(alice, %s) = false, want true", tt.valid)
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode body error = %v", err)
+			}
+			if tt.status == http.StatusOK && (body["status"] != "ok" || body["users"] != float64(2)) {
+				t.Errorf("body = %v, want status ok and 2 users", body)
+			}
+			if msg, _ := body["msg"].(string); tt.status != http.StatusOK && msg == "" {
+				t.Errorf("body = %v, want an error message", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,530 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readAuthFiles reads and merges several auth files. When a user appears in
+// more than one file the last file wins, and the user is reported in the
+// returned duplicates.
+func readAuthFiles(filenames []string, token string) (map[string][]string, []string, error) {
+	FileAuthMaps := make([]map[string][]string, 0, len(filenames))
+	for _, filename := range filenames {
+		FileAuthMap, err := readAuthFile(filename, token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", redactAuthFile(filename), err)
+		}
+		FileAuthMaps = append(FileAuthMaps, FileAuthMap)
+	}
+	AuthMap, duplicates := mergeAuthMaps(FileAuthMaps)
+	return AuthMap, duplicates, nil
+}
+
+// mergeAuthMaps merges the entries of several auth files, in order.
+func mergeAuthMaps(FileAuthMaps []map[string][]string) (map[string][]string, []string) {
+	AuthMap := make(map[string][]string)
+	var duplicates []string
+	for _, FileAuthMap := range FileAuthMaps {
+		for user, entries := range FileAuthMap {
+			if _, ok := AuthMap[user]; ok {
+				duplicates = append(duplicates, user)
+			}
+			AuthMap[user] = entries
+		}
+	}
+	return AuthMap, duplicates
+}
+
+func splitAuthFiles(s string) []string {
+	var filenames []string
+	for _, filename := range strings.Split(s, ",") {
+		filename = strings.TrimSpace(filename)
+		if filename != "" {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// readAuthFile returns the entries of every user in the file, which may be
+// an http(s) URL fetched with the bearer token if set. A user may have
+// several entries, each with its own password.
+func readAuthFile(filename, token string) (map[string][]string, error) {
+	AuthDataBytes, ext, err := readAuthSource(filename, token)
+	if err != nil {
+		return nil, err
+	}
+	switch authFileFormat(ext, AuthDataBytes) {
+	case authFormatYAML:
+		return parseAuthYAML(AuthDataBytes)
+	case authFormatJSON:
+		return parseAuthJSON(AuthDataBytes)
+	default:
+		return parseAuthKV(AuthDataBytes), nil
+	}
+}
+
+// The formats of auth files.
+const (
+	authFormatKV   = "kv"
+	authFormatJSON = "json"
+	authFormatYAML = "yaml"
+)
+
+// authFileFormat picks the format of an auth file by its extension, or for
+// other extensions JSON if the content looks like an object, and
+// `user=password` lines otherwise. Files are read and written back in the
+// format it picks.
+func authFileFormat(ext string, AuthDataBytes []byte) string {
+	switch ext {
+	case ".yaml", ".yml":
+		return authFormatYAML
+	case ".json":
+		return authFormatJSON
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(AuthDataBytes), []byte("{")) {
+		return authFormatJSON
+	}
+	return authFormatKV
+}
+
+const authURLTimeout = 10 * time.Second
+
+const maxAuthURLBytes = 16 << 20
+
+var authURLClient = &http.Client{Timeout: authURLTimeout}
+
+func isAuthURL(filename string) bool {
+	return strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://")
+}
+
+// redactAuthFile hides the credentials an auth URL may carry in its
+// userinfo or query, before it is logged or shown. Other auth files are
+// returned as is.
+func redactAuthFile(filename string) string {
+	if !isAuthURL(filename) {
+		return filename
+	}
+	authURL, err := url.Parse(filename)
+	if err != nil {
+		return redact(filename)
+	}
+	if authURL.User != nil {
+		authURL.User = url.User("redacted")
+	}
+	if authURL.RawQuery != "" {
+		authURL.RawQuery = "redacted"
+	}
+	return authURL.String()
+}
+
+// redactURLError redacts the auth URL an error of net/url or net/http
+// carries.
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: urlErr.Op, URL: redactAuthFile(urlErr.URL), Err: urlErr.Err}
+	}
+	return err
+}
+
+// redactAuthFiles is redactAuthFile for a list of auth files, joined with
+// commas as they are configured.
+func redactAuthFiles(filenames []string) string {
+	redacted := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		redacted = append(redacted, redactAuthFile(filename))
+	}
+	return strings.Join(redacted, ",")
+}
+
+// readAuthSource reads an auth file or fetches an auth URL, and returns its
+// extension, which picks the format.
+func readAuthSource(filename, token string) ([]byte, string, error) {
+	if !isAuthURL(filename) {
+		AuthDataBytes, err := os.ReadFile(filename)
+		return AuthDataBytes, strings.ToLower(filepath.Ext(filename)), err
+	}
+	authURL, err := url.Parse(filename)
+	if err != nil {
+		return nil, "", redactURLError(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, filename, nil)
+	if err != nil {
+		return nil, "", redactURLError(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := authURLClient.Do(req)
+	if err != nil {
+		return nil, "", redactURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetch auth url error: %s", resp.Status)
+	}
+	AuthDataBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxAuthURLBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(AuthDataBytes) > maxAuthURLBytes {
+		return nil, "", fmt.Errorf("auth url body exceeds %d bytes", maxAuthURLBytes)
+	}
+	return AuthDataBytes, strings.ToLower(path.Ext(authURL.Path)), nil
+}
+
+// parseAuthData parses auth data of unknown origin, JSON if it looks like
+// an object and `user=password` lines otherwise.
+func parseAuthData(AuthDataBytes []byte) (map[string][]string, error) {
+	if authFileFormat("", AuthDataBytes) == authFormatJSON {
+		return parseAuthJSON(AuthDataBytes)
+	}
+	return parseAuthKV(AuthDataBytes), nil
+}
+
+// parseAuthKV parses `user=password` lines. Leading and trailing spaces are
+// trimmed from lines, users and passwords; the password is everything after
+// the first `=`, so it may itself contain `=`. Blank lines, `#` comments,
+// lines without `=` and entries with an empty password are skipped. A user
+// listed twice gets both passwords, e.g. while rotating them.
+func parseAuthKV(AuthDataBytes []byte) map[string][]string {
+	AuthData := string(AuthDataBytes)
+	// Normalize CRLF so that files saved on Windows parse like LF files.
+	AuthData = strings.ReplaceAll(AuthData, "\r\n", "\n")
+	AuthMap := make(map[string][]string)
+	for _, row := range strings.Split(AuthData, "\n") {
+		row = strings.TrimSpace(row)
+		if row == "" || strings.HasPrefix(row, "#") {
+			continue
+		}
+		if strings.Contains(row, "=") {
+			kvs := strings.SplitN(row, "=", 2)
+			if strings.TrimSpace(kvs[1]) != "" {
+				user := strings.TrimSpace(kvs[0])
+				AuthMap[user] = append(AuthMap[user], strings.TrimSpace(kvs[1]))
+			}
+		}
+	}
+	return AuthMap
+}
+
+// authEntries is the value of a user in a JSON or YAML auth file, either a
+// single password or a list of passwords.
+type authEntries []string
+
+func (e *authEntries) UnmarshalJSON(data []byte) error {
+	var entry string
+	if json.Unmarshal(data, &entry) == nil {
+		*e = authEntries{entry}
+		return nil
+	}
+	var entries []string
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return errors.New("password must be a string or a list of strings")
+	}
+	*e = entries
+	return nil
+}
+
+func (e *authEntries) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var entries []string
+		err := value.Decode(&entries)
+		if err != nil {
+			return err
+		}
+		*e = entries
+		return nil
+	}
+	var entry string
+	err := value.Decode(&entry)
+	if err != nil {
+		return err
+	}
+	*e = authEntries{entry}
+	return nil
+}
+
+func parseAuthJSON(AuthDataBytes []byte) (map[string][]string, error) {
+	var raw map[string]authEntries
+	err := json.Unmarshal(AuthDataBytes, &raw)
+	if err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(AuthDataBytes[:syntaxErr.Offset], []byte("\n")) + 1
+			return nil, fmt.Errorf("parse json auth file error at line %d: %v", line, err)
+		}
+		return nil, fmt.Errorf("parse json auth file error: %v", err)
+	}
+	return trimAuthMap(raw), nil
+}
+
+func parseAuthYAML(AuthDataBytes []byte) (map[string][]string, error) {
+	var raw map[string]authEntries
+	err := yaml.Unmarshal(AuthDataBytes, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse yaml auth file error: %v", err)
+	}
+	return trimAuthMap(raw), nil
+}
+
+func trimAuthMap(raw map[string]authEntries) map[string][]string {
+	AuthMap := make(map[string][]string)
+	for user, entries := range raw {
+		user = strings.TrimSpace(user)
+		for _, entry := range entries {
+			if strings.TrimSpace(entry) != "" {
+				AuthMap[user] = append(AuthMap[user], strings.TrimSpace(entry))
+			}
+		}
+	}
+	return AuthMap
+}
+
+// writeAuthFile writes the entries back to an auth file, in the format
+// readAuthFile picks for it, see authFileFormat. The comments and order of
+// the current file are kept for `user=password` and YAML files, see
+// authLines and updateAuthYAML; JSON has no comments and is written sorted.
+// The entries are written to a temporary file which is renamed into place,
+// so readers never see a partial file.
+func writeAuthFile(filename string, AuthMap map[string][]string) error {
+	OldDataBytes, readErr := os.ReadFile(filename)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		return readErr
+	}
+	var AuthDataBytes []byte
+	var err error
+	switch authFileFormat(strings.ToLower(filepath.Ext(filename)), OldDataBytes) {
+	case authFormatJSON:
+		AuthDataBytes, err = json.MarshalIndent(authFileValues(AuthMap), "", "  ")
+		AuthDataBytes = append(AuthDataBytes, '\n')
+	case authFormatYAML:
+		AuthDataBytes, err = updateAuthYAML(OldDataBytes, AuthMap)
+	default:
+		lines := parseAuthLines(OldDataBytes)
+		lines.update(AuthMap)
+		AuthDataBytes = lines.Bytes()
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, AuthDataBytes)
+}
+
+// authFileValues returns the value of every user in a JSON or YAML auth
+// file, a single password or a list of them.
+func authFileValues(AuthMap map[string][]string) map[string]interface{} {
+	raw := make(map[string]interface{}, len(AuthMap))
+	for user, entries := range AuthMap {
+		raw[user] = authFileValue(entries)
+	}
+	return raw
+}
+
+func authFileValue(entries []string) interface{} {
+	if len(entries) == 1 {
+		return entries[0]
+	}
+	return entries
+}
+
+// authLine is a line of a `user=password` file. User is empty for lines
+// which are not an entry, such as comments and blank lines.
+type authLine struct {
+	Raw   string
+	User  string
+	Entry string
+}
+
+// authLines is a `user=password` file as read, line by line, so that it
+// can be written back with its comments and order after an update.
+type authLines []authLine
+
+// parseAuthLines splits a `user=password` file into lines, recognizing the
+// entries the way parseAuthKV does.
+func parseAuthLines(AuthDataBytes []byte) authLines {
+	AuthData := strings.ReplaceAll(string(AuthDataBytes), "\r\n", "\n")
+	AuthData = strings.TrimSuffix(AuthData, "\n")
+	if AuthData == "" {
+		return nil
+	}
+	var lines authLines
+	for _, row := range strings.Split(AuthData, "\n") {
+		line := authLine{Raw: row}
+		trimmed := strings.TrimSpace(row)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") && strings.Contains(trimmed, "=") {
+			kvs := strings.SplitN(trimmed, "=", 2)
+			if strings.TrimSpace(kvs[1]) != "" {
+				line.User = strings.TrimSpace(kvs[0])
+				line.Entry = strings.TrimSpace(kvs[1])
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// update makes the entries of the lines those of AuthMap. The lines of a
+// user whose entries are unchanged are left as they are. The entries of a
+// changed user replace its lines at the place of the first one, the lines
+// of a removed user are dropped, and new users are appended in sort order.
+func (lines *authLines) update(AuthMap map[string][]string) {
+	OldMap := make(map[string][]string)
+	for _, line := range *lines {
+		if line.User != "" {
+			OldMap[line.User] = append(OldMap[line.User], line.Entry)
+		}
+	}
+	var updated authLines
+	written := make(map[string]bool)
+	for _, line := range *lines {
+		entries, ok := AuthMap[line.User]
+		switch {
+		case line.User == "" || ok && equalStrings(OldMap[line.User], entries):
+			updated = append(updated, line)
+		case ok && !written[line.User]:
+			for _, entry := range entries {
+				updated = append(updated, newAuthLine(line.User, entry))
+			}
+		}
+		written[line.User] = true
+	}
+	users := make([]string, 0, len(AuthMap))
+	for user := range AuthMap {
+		if !written[user] {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		for _, entry := range AuthMap[user] {
+			updated = append(updated, newAuthLine(user, entry))
+		}
+	}
+	*lines = updated
+}
+
+func newAuthLine(user, entry string) authLine {
+	return authLine{Raw: user + "=" + entry, User: user, Entry: entry}
+}
+
+func (lines authLines) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line.Raw)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// updateAuthYAML makes the users of a YAML auth file those of AuthMap,
+// editing the parsed document so that its comments and order are kept.
+// New users are appended in sort order.
+func updateAuthYAML(AuthDataBytes []byte, AuthMap map[string][]string) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(AuthDataBytes, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("parse yaml auth file error: %v", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return yaml.Marshal(authFileValues(AuthMap))
+	}
+	mapping := doc.Content[0]
+	written := make(map[string]bool)
+	content := mapping.Content[:0:0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		user := strings.TrimSpace(key.Value)
+		entries, ok := AuthMap[user]
+		if !ok || written[user] {
+			continue
+		}
+		written[user] = true
+		var OldEntries authEntries
+		if value.Decode(&OldEntries) != nil || !equalStrings(trimAuthMap(map[string]authEntries{user: OldEntries})[user], entries) {
+			newValue, err := authYAMLValue(entries)
+			if err != nil {
+				return nil, err
+			}
+			newValue.LineComment = value.LineComment
+			value = newValue
+		}
+		content = append(content, key, value)
+	}
+	users := make([]string, 0, len(AuthMap))
+	for user := range AuthMap {
+		if !written[user] {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		value, err := authYAMLValue(AuthMap[user])
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: user}, value)
+	}
+	mapping.Content = content
+	return yaml.Marshal(&doc)
+}
+
+func authYAMLValue(entries []string) (*yaml.Node, error) {
+	var value yaml.Node
+	err := value.Encode(authFileValue(entries))
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// writeFileAtomic writes data to filename.tmp in the same directory and
+// renames it into place, so readers such as the inotify reload see either
+// the old or the new content. The mode of an existing file is kept, and a
+// symlinked file is replaced at its target rather than replacing the link.
+func writeFileAtomic(filename string, data []byte) error {
+	mode := os.FileMode(0600)
+	if realPath, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = realPath
+	}
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmpFilename := filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	// OpenFile applies the umask, set the mode explicitly
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+	}
+	return err
+}
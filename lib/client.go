@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fatedier/frp/pkg/msg"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"net/http"
+)
+
+// DefaultPasswordMetaKey is the frpc meta holding the password unless
+// configured otherwise.
+const DefaultPasswordMetaKey = "password"
+
+// Login posts a Login plugin request for user to endpoint, the way frps
+// does, and returns the response of the plugin.
+func Login(endpoint, user, password string) (plugin.Response, error) {
+	return LoginWithClient(http.DefaultClient, endpoint, user, password)
+}
+
+// LoginWithClient is Login with a given client, e.g. one set up for TLS or
+// with a timeout.
+func LoginWithClient(client *http.Client, endpoint, user, password string) (plugin.Response, error) {
+	return postPluginRequest(client, endpoint, plugin.OpLogin, &plugin.LoginContent{
+		Login: msg.Login{
+			User:  user,
+			Metas: map[string]string{DefaultPasswordMetaKey: password},
+		},
+	})
+}
+
+func postPluginRequest(client *http.Client, endpoint, op string, content interface{}) (plugin.Response, error) {
+	var pluginResponse plugin.Response
+	body, err := json.Marshal(&plugin.Request{
+		Version: plugin.APIVersion,
+		Op:      op,
+		Content: content,
+	})
+	if err != nil {
+		return pluginResponse, err
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return pluginResponse, err
+	}
+	defer resp.Body.Close()
+	// a rejection is answered with 403 when StrictHTTP is set, any other
+	// error with a message
+	var result struct {
+		plugin.Response
+		Msg string `json:"msg"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return pluginResponse, fmt.Errorf("decode response, status %d: %v", resp.StatusCode, err)
+	}
+	if result.Msg != "" || (resp.StatusCode != http.StatusOK && !result.Reject) {
+		return pluginResponse, fmt.Errorf("status %d: %s", resp.StatusCode, result.Msg)
+	}
+	return result.Response, nil
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		password string
+		reject   bool
+		wantErr  string
+	}{
+		{name: "accepted", cfg: Config{AuthData: "alice=x"}, password: "x"},
+		{name: "rejected", cfg: Config{AuthData: "alice=x"}, password: "y", reject: true},
+		{name: "rejected with 403", cfg: Config{AuthData: "alice=x", StrictHTTP: true}, password: "y", reject: true},
+		{name: "missing endpoint token", cfg: Config{AuthData: "alice=x", AuthToken: "secret"}, password: "x", wantErr: "status 401: unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(newTestServer(t, tt.cfg).Handler())
+			defer ts.Close()
+			resp, err := Login(ts.URL+"/handler", "alice", tt.password)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Login() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Login() error = %v", err)
+			}
+			if resp.Reject != tt.reject {
+				t.Errorf("reject = %v (%s), want %v", resp.Reject, resp.RejectReason, tt.reject)
+			}
+		})
+	}
+}
+
+func TestLoginWithClient(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t, Config{AuthData: "alice=x"}).Handler())
+	defer ts.Close()
+	// frps posts Login with the plugin protocol, check what arrives
+	var got *http.Request
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		got = r
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	resp, err := LoginWithClient(client, ts.URL+"/handler", "alice", "x")
+	if err != nil || resp.Reject {
+		t.Fatalf("LoginWithClient() = %+v, %v, want accepted", resp, err)
+	}
+	if got == nil || got.Method != http.MethodPost || got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("request = %v, want a json POST through the given client", got)
+	}
+
+	// e.g. a proxy in front failing
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	if _, err := LoginWithClient(client, proxy.URL+"/handler", "alice", "x"); err == nil || !strings.Contains(err.Error(), "status 502") {
+		t.Errorf("LoginWithClient() through a failing proxy error = %v, want status 502", err)
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
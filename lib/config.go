@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Config holds the server options. The yaml keys match the command line
+// flag names, so a config file can set any flag.
+type Config struct {
+	BindAddress string `yaml:"addr"`
+	// Network is tcp, tcp4 or tcp6, the network the tcp addresses are
+	// bound on. Empty is tcp, dual stack where available.
+	Network  string `yaml:"network"`
+	AuthFile string `yaml:"auth_file"`
+	// StagedAuthFile is swapped with AuthFile by POST /promote on the
+	// admin api.
+	StagedAuthFile string `yaml:"staged_auth_file"`
+	// AuthData holds the credentials themselves, in the auth file format,
+	// and takes precedence over AuthFile. It is never reloaded, so
+	// inotify and SIGHUP reloads only re-read the policy file.
+	AuthData      string `yaml:"auth_data"`
+	DBPath        string `yaml:"db"`
+	RedisAddr     string `yaml:"redis_addr"`
+	RedisPassword string `yaml:"redis_password"`
+	RedisDB       int    `yaml:"redis_db"`
+	RedisChannel  string `yaml:"redis_channel"`
+	LDAPURL       string `yaml:"ldap_url"`
+	LDAPBindDN    string `yaml:"ldap_bind_dn"`
+	LDAPBaseDN    string `yaml:"ldap_base_dn"`
+	PolicyFile    string `yaml:"policy_file"`
+	// BackendTimeout bounds each verification against the sqlite, redis
+	// and ldap backends. Zero only bounds it by the plugin request.
+	BackendTimeout time.Duration `yaml:"backend_timeout"`
+	// CacheTTL caches the verifications of the sqlite, redis and ldap
+	// backends, failed ones for a tenth of it. Zero disables the cache.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// PasswordMetaKey is the frpc meta holding the password. Empty is
+	// DefaultPasswordMetaKey.
+	PasswordMetaKey string `yaml:"password_key"`
+	Inotify         bool   `yaml:"inotify"`
+	// PollInterval checks the auth files for changes at this interval,
+	// alongside or instead of inotify. Zero disables polling.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// An auth file may be an http(s) URL, fetched with AuthURLToken as the
+	// bearer token if set and fetched again every AuthURLInterval. A failed
+	// fetch keeps the users loaded before.
+	AuthURLToken    string        `yaml:"auth_url_token"`
+	AuthURLInterval time.Duration `yaml:"auth_url_interval"`
+	TLSCertFile     string        `yaml:"tls_cert"`
+	TLSKeyFile      string        `yaml:"tls_key"`
+	AuthToken       string        `yaml:"endpoint_token"`
+	// AllowCIDRs and DenyCIDRs are comma separated CIDRs filtering the
+	// addresses plugin requests are accepted from. Deny takes precedence,
+	// and an empty allowlist allows every address.
+	AllowCIDRs string `yaml:"allow_cidrs"`
+	DenyCIDRs  string `yaml:"deny_cidrs"`
+	Metrics    bool   `yaml:"metrics"`
+	// Gzip compresses the responses for clients accepting it.
+	Gzip bool `yaml:"gzip"`
+	// VersionEndpoint serves the build information at /version.
+	VersionEndpoint bool `yaml:"version_endpoint"`
+	// AdminAddr enables the admin API on a separate listener, protected
+	// by AdminToken.
+	AdminAddr  string `yaml:"admin_addr"`
+	AdminToken string `yaml:"admin_token"`
+	// MaxBodyBytes limits the size of a plugin request body. Zero uses
+	// defaultMaxBodyBytes.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// MaxConcurrent limits the plugin requests handled at once, answering
+	// the others with 503. Zero is unlimited.
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// HTTP server timeouts, zero uses the defaults from server.go.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// Keep-alives are on by default, idle connections being closed after
+	// IdleTimeout. DisableKeepAlives closes every connection after one
+	// request, for debugging. HTTP/2 is negotiated automatically with
+	// TLS; H2C also accepts it over cleartext, which frps does not use.
+	DisableKeepAlives bool `yaml:"disable_keep_alives"`
+	H2C               bool `yaml:"h2c"`
+	// MaxProxies is the default limit of active proxies per user, which
+	// the policy can override. Zero is unlimited.
+	MaxProxies int `yaml:"max_proxies"`
+	// RateLimit is the number of login attempts per second allowed from
+	// one client ip, the frpc address frps sends with Login, with bursts of
+	// RateBurst. Zero disables it.
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+	// UserRateLimit and UserRateBurst limit the login attempts per user the
+	// same way, against guessing from many addresses. A login must pass
+	// both limits.
+	UserRateLimit float64 `yaml:"user_rate_limit"`
+	UserRateBurst int     `yaml:"user_rate_burst"`
+	// RateLimitStatus is the http status of throttled logins, sent with
+	// Retry-After, apart from the status of rejected logins. Zero is 429.
+	RateLimitStatus int `yaml:"rate_limit_status"`
+	// StrictHTTP answers rejected requests with 403 instead of 200, for
+	// tooling other than frps. Leave it off behind frps: frps treats any
+	// status other than 200 as a plugin failure rather than reading the
+	// reject reason.
+	StrictHTTP bool `yaml:"strict_http"`
+	// MaintenanceFile puts the server in maintenance mode while it exists,
+	// as does POST /maintenance on the admin api. Logins are then rejected
+	// with MaintenanceMessage; established sessions are not affected.
+	MaintenanceFile    string `yaml:"maintenance_file"`
+	MaintenanceMessage string `yaml:"maintenance_message"`
+	// ProxyNamePolicy is enforce, warn or off, see ProxyNameEnforce. Empty
+	// is enforce.
+	ProxyNamePolicy string `yaml:"proxy_name_policy"`
+	// StrictJSON rejects requests with fields unknown to the frp plugin
+	// protocol or missing fields the op needs, for debugging. Keep it off,
+	// newer frp versions add fields.
+	StrictJSON bool `yaml:"strict_json"`
+	// GenericRejectMessage rejects unknown users and wrong passwords with
+	// the same "invalid credentials", without echoing the user.
+	// Recommended, off by default to keep the previous message.
+	GenericRejectMessage bool `yaml:"generic_reject"`
+	// CheckUserConn checks the credentials of the proxy owner again on
+	// every NewUserConn.
+	CheckUserConn bool `yaml:"check_user_conn"`
+	// CaseInsensitiveUser lowercases user names, both in the auth file and
+	// in plugin requests.
+	CaseInsensitiveUser bool `yaml:"ci_user"`
+	// AllowEmptyAuth accepts reloads which leave no users.
+	AllowEmptyAuth bool `yaml:"allow_empty_auth"`
+	// SkipFailedAuthFiles loads the other auth files when one of several
+	// can not be read, and logs the failed ones. By default the load fails.
+	SkipFailedAuthFiles bool `yaml:"skip_failed_auth_files"`
+	// ReloadDebounce coalesces auth file reloads triggered within this
+	// window. Zero reloads on every trigger.
+	ReloadDebounce time.Duration `yaml:"reload_debounce"`
+	LogFormat      string        `yaml:"log_format"`
+	// AccessLog logs every http request with its status and duration.
+	AccessLog bool `yaml:"access_log"`
+	// LogLevel is debug, info, warn or error. Empty is info.
+	LogLevel string `yaml:"log_level"`
+	// TrustForwarded takes the client address from X-Real-IP, when the
+	// request comes from one of the TrustedProxies, which must be set.
+	TrustForwarded bool `yaml:"trust_forwarded"`
+	// TrustedProxies are comma separated CIDRs of the reverse proxies whose
+	// X-Forwarded-For is honored; the rightmost hop which is not a trusted
+	// proxy is the client.
+	TrustedProxies string `yaml:"trusted_proxies"`
+	// OTel traces the plugin requests and backend calls, exported over
+	// OTLP as configured by the OTEL_EXPORTER_OTLP_* environment variables.
+	OTel bool `yaml:"otel"`
+	// TracerProvider, when set, is used instead of the one set up by OTel.
+	TracerProvider trace.TracerProvider `yaml:"-"`
+	// Logger, when set, is used instead of the one set up by LogFormat and
+	// LogLevel, e.g. to log into the application embedding the server.
+	Logger *slog.Logger `yaml:"-"`
+}
+
+// Proxy name policies, what to do with a NewProxy whose name is not
+// prefixed with the user, as frpc does.
+const (
+	ProxyNameEnforce = "enforce"
+	ProxyNameWarn    = "warn"
+	ProxyNameOff     = "off"
+)
+
+// LoadConfigFile reads a YAML (or JSON) config file into cfg. Keys missing
+// from the file leave the current values untouched, and unknown keys are
+// an error.
+func LoadConfigFile(filename string, cfg *Config) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
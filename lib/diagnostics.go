@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"log/slog"
+	"time"
+)
+
+// startupInfo summarizes the loaded configuration for the startup log. It
+// must never carry secrets such as tokens or passwords.
+type startupInfo struct {
+	Addr      string
+	AdminAddr string
+	Backend   string
+	AuthFile  string
+	Inotify   bool
+	Poll      time.Duration
+	Users     int
+	TLS       bool
+	RateLimit bool
+	Metrics   bool
+	CacheTTL  time.Duration
+}
+
+func (i startupInfo) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("addr", i.Addr),
+		slog.String("backend", i.Backend),
+	}
+	if i.AdminAddr != "" {
+		attrs = append(attrs, slog.String("admin_addr", i.AdminAddr))
+	}
+	switch i.Backend {
+	case "file":
+		attrs = append(attrs,
+			slog.String("auth_file", i.AuthFile),
+			slog.Bool("inotify", i.Inotify),
+			slog.Duration("poll_interval", i.Poll),
+			slog.Int("users", i.Users),
+		)
+	case "auth_data":
+		attrs = append(attrs, slog.Int("users", i.Users))
+	}
+	if i.CacheTTL > 0 {
+		attrs = append(attrs, slog.Duration("cache_ttl", i.CacheTTL))
+	}
+	attrs = append(attrs,
+		slog.Bool("tls", i.TLS),
+		slog.Bool("rate_limit", i.RateLimit),
+		slog.Bool("metrics", i.Metrics),
+	)
+	return slog.GroupValue(attrs...)
+}
+
+func (s *Server) startupInfo() startupInfo {
+	info := startupInfo{
+		Addr:      s.cfg.BindAddress,
+		TLS:       s.cfg.TLSCertFile != "",
+		RateLimit: s.limiter != nil || s.userLimiter != nil,
+		Metrics:   s.metrics != nil,
+	}
+	if s.admin != nil {
+		info.AdminAddr = s.admin.Addr
+	}
+	if c, ok := s.store.(*CachedStore); ok {
+		info.CacheTTL = c.TTL
+	}
+	switch store := unwrapStore(s.store).(type) {
+	case *SQLiteStore:
+		info.Backend = "sqlite"
+	case *RedisStore:
+		info.Backend = "redis"
+	case *LDAPStore:
+		info.Backend = "ldap"
+	case *Map:
+		if store.AuthData != nil {
+			info.Backend = "auth_data"
+			info.Users = store.Len()
+			break
+		}
+		info.Backend = "file"
+		info.AuthFile = s.authFile()
+		info.Inotify = s.cfg.Inotify
+		info.Poll = s.cfg.PollInterval
+		info.Users = store.Len()
+	}
+	return info
+}
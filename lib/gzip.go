@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// readBody reads a request body of at most maxBytes, decompressing it when
+// a proxy in front sent it gzip encoded. The limit applies to the body
+// after decompression as well.
+func readBody(w http.ResponseWriter, r *http.Request, maxBytes int64) ([]byte, error) {
+	body := io.Reader(http.MaxBytesReader(w, r.Body, maxBytes))
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return io.ReadAll(body)
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			// a body cut off by the limit within the gzip header is too
+			// large, not malformed
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, err
+			}
+			return nil, &statusError{status: http.StatusBadRequest, err: fmt.Errorf("read gzip body error: %v", err)}
+		}
+		defer gz.Close()
+		data, err := io.ReadAll(io.LimitReader(gz, maxBytes+1))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, err
+			}
+			return nil, &statusError{status: http.StatusBadRequest, err: fmt.Errorf("read gzip body error: %v", err)}
+		}
+		if int64(len(data)) > maxBytes {
+			return nil, &http.MaxBytesError{Limit: maxBytes}
+		}
+		return data, nil
+	default:
+		return nil, &statusError{status: http.StatusUnsupportedMediaType, err: fmt.Errorf("unsupported content encoding `%s`", encoding)}
+	}
+}
+
+// gzipResponseWriter compresses the body written through it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+// gzipResponses compresses the responses of next for clients accepting
+// gzip. next sees the request without Accept-Encoding, so that handlers
+// which compress on their own, such as /metrics, do not compress twice.
+func gzipResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Del("Accept-Encoding")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, item := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(item, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.ReplaceAll(param, " ", "")
+			if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"gzip;q=0.001", true},
+		{"br", false},
+		{"x-gzip", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/handler", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGzipRequestAndResponse(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", Gzip: true})
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte(`{"version":"` + plugin.APIVersion + `","op":"Login","content":{"user":"alice","metas":{"password":"x"}}}`))
+	_ = gz.Close()
+	r := httptest.NewRequest(http.MethodPost, "/handler", &body)
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	var resp plugin.Response
+	if err := json.NewDecoder(gr).Decode(&resp); err != nil {
+		t.Fatalf("decode response error = %v", err)
+	}
+	if resp.Reject {
+		t.Errorf("gzip login rejected: %s", resp.RejectReason)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/handler", bytes.NewReader([]byte("not gzip")))
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid gzip body status = %d, want 400", w.Code)
+	}
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding = %q without Accept-Encoding, want none", encoding)
+	}
+}
+
+func TestGzipRequestTooLarge(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte(`{"version":"` + plugin.APIVersion + `","op":"Login","content":{"user":"alice","metas":{"password":"x"}}}`))
+	_ = gz.Close()
+	tests := []struct {
+		name         string
+		maxBodyBytes int64
+		status       int
+	}{
+		// the gzip header alone is 10 bytes
+		{name: "limit within the gzip header", maxBodyBytes: 5, status: http.StatusRequestEntityTooLarge},
+		{name: "limit within the compressed body", maxBodyBytes: int64(body.Len()) - 5, status: http.StatusRequestEntityTooLarge},
+		{name: "limit above the body", maxBodyBytes: 1024, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", MaxBodyBytes: tt.maxBodyBytes})
+			r := httptest.NewRequest(http.MethodPost, "/handler", bytes.NewReader(body.Bytes()))
+			r.Header.Set("Content-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,776 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// opRequest carries a decoded plugin request to an opHandler. Handlers set
+// User once the content is decoded so that it can be logged.
+type opRequest struct {
+	Ctx     context.Context
+	Op      string
+	Content json.RawMessage
+	Store   AuthStore
+	Config  *Config
+	Logger  *slog.Logger
+	Proxies *proxyTracker
+	Limiter *rateLimiter
+	// UserLimiter limits the login attempts per user, Limiter per address.
+	UserLimiter *rateLimiter
+	Tracer      trace.Tracer
+	RemoteAddr  string
+	// Maintenance is the reject reason of logins in maintenance mode,
+	// empty otherwise.
+	Maintenance string
+	User        string
+}
+
+const defaultMaxBodyBytes = 64 << 10
+
+// readyTimeout bounds the backend check of /readyz.
+const readyTimeout = 5 * time.Second
+
+const genericRejectMessage = "invalid credentials"
+
+type opHandler func(req *opRequest) (plugin.Response, error)
+
+var opHandlers = map[string]opHandler{
+	plugin.OpLogin:       handleLogin,
+	plugin.OpNewProxy:    handleNewProxy,
+	plugin.OpCloseProxy:  handleCloseProxy,
+	plugin.OpPing:        handlePing,
+	plugin.OpNewUserConn: handleNewUserConn,
+}
+
+// knownOps are the operations of the frp plugin protocol. Those without an
+// opHandler are let through unchanged, anything else is rejected.
+var knownOps = map[string]bool{
+	plugin.OpLogin:       true,
+	plugin.OpNewProxy:    true,
+	plugin.OpCloseProxy:  true,
+	plugin.OpPing:        true,
+	plugin.OpNewWorkConn: true,
+	plugin.OpNewUserConn: true,
+}
+
+type statusError struct {
+	status int
+	err    error
+	// retryAfter, if set, is sent in the Retry-After header.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// handlePlugin serves the frp server plugin requests.
+func (s *Server) handlePlugin(w http.ResponseWriter, r *http.Request) {
+	if s.sem != nil {
+		select {
+		case s.sem <- struct{}{}:
+			defer func() { <-s.sem }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeMsg(w, http.StatusServiceUnavailable, "too many concurrent requests")
+			return
+		}
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.allowRemoteAddr(s.clientAddr(r)) {
+		writeMsg(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if s.cfg.AuthToken != "" && !checkBearerToken(r, s.cfg.AuthToken) {
+		writeMsg(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var pluginRequest plugin.Request
+	var content json.RawMessage
+	pluginRequest.Content = &content
+	maxBodyBytes := s.cfg.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	byteData, err := readBody(w, r, maxBodyBytes)
+	_ = r.Body.Close()
+	if err != nil {
+		status := http.StatusInternalServerError
+		var maxBytesErr *http.MaxBytesError
+		var se *statusError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		} else if errors.As(err, &se) {
+			status = se.status
+		}
+		writeMsg(w, status, err.Error())
+		return
+	}
+	err = decodeJSON(byteData, &pluginRequest, s.cfg.StrictJSON)
+	if err != nil {
+		writeMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if pluginRequest.Op == "" {
+		writeMsg(w, http.StatusBadRequest, "missing op")
+		return
+	}
+	if pluginRequest.Version != plugin.APIVersion {
+		s.logger.Warn("unexpected plugin api version", "version", pluginRequest.Version, "expected", plugin.APIVersion, "op", pluginRequest.Op)
+	}
+	handle, ok := opHandlers[pluginRequest.Op]
+	if !ok {
+		if !knownOps[pluginRequest.Op] {
+			s.logger.Warn("reject unsupported plugin request", "op", pluginRequest.Op)
+			status := http.StatusOK
+			if s.cfg.StrictHTTP {
+				status = http.StatusForbidden
+			}
+			writeJSON(w, status, plugin.Response{Reject: true, RejectReason: fmt.Sprintf("unsupported operation `%s`", pluginRequest.Op)})
+			return
+		}
+		s.logger.Debug("unhandled plugin request", "op", pluginRequest.Op)
+		writeJSON(w, http.StatusOK, plugin.Response{Unchange: true})
+		return
+	}
+	if !isJSONObject(content) {
+		writeMsg(w, http.StatusBadRequest, fmt.Sprintf("content of op `%s` must be an object", pluginRequest.Op))
+		return
+	}
+	remoteAddr := s.clientAddr(r)
+	ctx, span := s.tracer.Start(r.Context(), "plugin "+pluginRequest.Op, trace.WithAttributes(attribute.String("frp.op", pluginRequest.Op)))
+	defer span.End()
+	req := &opRequest{
+		Ctx:         ctx,
+		Op:          pluginRequest.Op,
+		Content:     content,
+		Store:       s.store,
+		Config:      &s.cfg,
+		Logger:      s.logger,
+		Proxies:     s.proxies,
+		Limiter:     s.limiter,
+		UserLimiter: s.userLimiter,
+		Tracer:      s.tracer,
+		RemoteAddr:  remoteAddr,
+	}
+	if pluginRequest.Op == plugin.OpLogin {
+		req.Maintenance = s.maintenanceMessage()
+	}
+	pluginResponse, err := handle(req)
+	setAccessUser(r, req.User)
+	span.SetAttributes(attribute.String("frp.user", req.User), attribute.String("frp.decision", decision(pluginResponse, err)))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	s.logger.Debug("plugin request", "op", pluginRequest.Op, "user", req.User, "remote_addr", remoteAddr)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if se, ok := err.(*statusError); ok {
+			status = se.status
+			if se.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(se.retryAfter)))
+			}
+		}
+		if status < http.StatusInternalServerError {
+			s.logger.Warn("reject plugin request", "op", pluginRequest.Op, "user", req.User, "remote_addr", remoteAddr, "status", status, "reason", err.Error())
+		} else {
+			s.logger.Error("handle plugin request error", "op", pluginRequest.Op, "user", req.User, "remote_addr", remoteAddr, "error", err)
+		}
+		writeMsg(w, status, err.Error())
+		return
+	}
+	status := http.StatusOK
+	if pluginResponse.Reject {
+		s.logger.Warn("reject plugin request", "op", pluginRequest.Op, "user", req.User, "remote_addr", remoteAddr, "reason", pluginResponse.RejectReason)
+		if s.cfg.StrictHTTP {
+			status = http.StatusForbidden
+		}
+	} else if pluginRequest.Op == plugin.OpLogin {
+		s.logger.Info("accept login", "user", req.User, "remote_addr", remoteAddr)
+	}
+	writeJSON(w, status, pluginResponse)
+}
+
+func (req *opRequest) decodeContent(v interface{}) error {
+	err := decodeJSON(req.Content, v, req.Config.StrictJSON)
+	if err == nil && req.Config.StrictJSON {
+		err = validateRequest(req.Op, v)
+	}
+	if err != nil {
+		return &statusError{status: http.StatusBadRequest, err: err}
+	}
+	return nil
+}
+
+// validateRequest checks that the decoded content of op carries the fields
+// the op needs, with StrictJSON. Lenient decoding does not need it: missing
+// metas decode to a nil map, which reads as empty, and an empty user or
+// password is answered by the handlers.
+func validateRequest(op string, content interface{}) error {
+	var missing []string
+	switch c := content.(type) {
+	case *plugin.LoginContent:
+		if c.User == "" {
+			missing = append(missing, "user")
+		}
+		if c.Metas == nil {
+			missing = append(missing, "metas")
+		}
+	case *plugin.NewProxyContent:
+		missing = missingUserInfo(&c.User)
+		if c.ProxyName == "" {
+			missing = append(missing, "proxy_name")
+		}
+		if c.ProxyType == "" {
+			missing = append(missing, "proxy_type")
+		}
+	case *plugin.CloseProxyContent:
+		missing = missingUserInfo(&c.User)
+		if c.ProxyName == "" {
+			missing = append(missing, "proxy_name")
+		}
+	case *plugin.PingContent:
+		missing = missingUserInfo(&c.User)
+	case *plugin.NewUserConnContent:
+		missing = missingUserInfo(&c.User)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("invalid `%s` request: missing %s", op, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func missingUserInfo(user *plugin.UserInfo) []string {
+	var missing []string
+	if user.User == "" {
+		missing = append(missing, "user.user")
+	}
+	if user.Metas == nil {
+		missing = append(missing, "user.metas")
+	}
+	return missing
+}
+
+// decision names the outcome of a plugin request for tracing.
+func decision(pluginResponse plugin.Response, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case pluginResponse.Reject:
+		return "reject"
+	default:
+		return "accept"
+	}
+}
+
+// decodeJSON decodes a single JSON value. Unknown fields are ignored, so
+// that newer frp versions keep working, unless strict is set.
+func decodeJSON(data []byte, v interface{}, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
+func isJSONObject(data json.RawMessage) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
+// verify checks the credentials of a user and returns a reject reason along
+// with its metrics category, or empty strings if the credentials are valid.
+func (req *opRequest) verify(user, password string) (string, string) {
+	req.Logger.Debug("verify credentials", "user", user, "password", redact(password), "remote_addr", req.RemoteAddr)
+	if user == "" || password == "" {
+		return "user or meta password can not be empty", rejectEmptyField
+	}
+	ctx := req.Ctx
+	if req.Config.BackendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Config.BackendTimeout)
+		defer cancel()
+	}
+	ctx, span := req.Tracer.Start(ctx, "verify", trace.WithAttributes(attribute.String("frp.user", user)))
+	check, err := verifyContext(ctx, req.Store, user, password)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	if err != nil {
+		req.Logger.Error("verify credentials error", "user", user, "remote_addr", req.RemoteAddr, "error", err)
+		return "auth backend unavailable", rejectBackendError
+	}
+	if !check {
+		if req.Config.GenericRejectMessage {
+			return genericRejectMessage, rejectInvalidCredentials
+		}
+		return fmt.Sprintf("user: `%s` invalid password", user), rejectInvalidCredentials
+	}
+	if ps, ok := req.Store.(PolicyStore); ok {
+		// checked after the password, so that it does not reveal the user
+		policy := ps.Policy(user)
+		if policy.disabled() {
+			return "account disabled", rejectDisabled
+		}
+		if policy.expired(now()) {
+			return "credential expired", rejectExpired
+		}
+	}
+	return "", ""
+}
+
+// skipEmpty reports whether an operation other than Login carries an empty
+// user or password, and is let through. Only Login requires them: frps
+// sends the other operations on behalf of a session whose Login was already
+// checked, and some of them, e.g. Ping, may come without the user context.
+func (req *opRequest) skipEmpty(user, password string) bool {
+	if user != "" && password != "" {
+		return false
+	}
+	req.Logger.Debug("skip credentials check with empty user or password", "user", user, "remote_addr", req.RemoteAddr)
+	return true
+}
+
+// checkClientAddr checks the address of frpc against the allowlist of the
+// user. frps sends the address of frpc along with Login; the address of the
+// plugin request itself, which is frps or a proxy in front of it, is only
+// used when that is missing.
+func (req *opRequest) checkClientAddr(user, clientAddr string) (string, string) {
+	ps, ok := req.Store.(PolicyStore)
+	if !ok {
+		return "", ""
+	}
+	if clientAddr == "" {
+		clientAddr = req.RemoteAddr
+	}
+	if !ps.Policy(user).allowAddr(clientAddr) {
+		return fmt.Sprintf("client address `%s` is not allowed for user `%s`", clientAddr, user), rejectAddressNotAllowed
+	}
+	return "", ""
+}
+
+// checkOTP checks the one-time password of users with a TOTP secret. It is
+// only done on Login: the other operations carry the metas of the login,
+// whose code has expired by then.
+func (req *opRequest) checkOTP(user string, metas map[string]string) (string, string) {
+	ps, ok := req.Store.(PolicyStore)
+	if !ok {
+		return "", ""
+	}
+	if !ps.Policy(user).checkOTP(metas[otpMetaKey], now()) {
+		if metas[otpMetaKey] == "" {
+			return fmt.Sprintf("missing one-time password for user `%s`", user), rejectInvalidOTP
+		}
+		return fmt.Sprintf("invalid one-time password for user `%s`", user), rejectInvalidOTP
+	}
+	return "", ""
+}
+
+// password returns the password meta, empty when frpc sent no metas at
+// all. The metas are only ever read, never written.
+func (req *opRequest) password(metas map[string]string) string {
+	if metas == nil {
+		return ""
+	}
+	return metas[req.Config.PasswordMetaKey]
+}
+
+// userName returns the name a user is looked up by, lowercased when
+// CaseInsensitiveUser is set.
+func (req *opRequest) userName(user string) string {
+	if req.Config.CaseInsensitiveUser {
+		return strings.ToLower(user)
+	}
+	return user
+}
+
+func handleLogin(req *opRequest) (plugin.Response, error) {
+	var pluginResponse plugin.Response
+	var pluginLoginContent plugin.LoginContent
+	err := req.decodeContent(&pluginLoginContent)
+	if err != nil {
+		return pluginResponse, err
+	}
+	loginAttempts.Inc()
+	user := req.userName(pluginLoginContent.User)
+	req.User = user
+	if req.Maintenance != "" {
+		loginRejected.WithLabelValues(rejectMaintenance).Inc()
+		pluginResponse.Reject = true
+		pluginResponse.RejectReason = req.Maintenance
+		return pluginResponse, nil
+	}
+	// frps is the peer of every plugin request, so the limiter is keyed by
+	// the address of frpc it sends along, as in checkClientAddr
+	clientAddr := pluginLoginContent.ClientAddress
+	if clientAddr == "" {
+		clientAddr = req.RemoteAddr
+	}
+	delay := req.Limiter.Delay(limiterKey(clientAddr))
+	if delay == 0 {
+		delay = req.UserLimiter.Delay(user)
+	}
+	if delay > 0 {
+		loginRejected.WithLabelValues(rejectRateLimited).Inc()
+		retryAfter := retryAfterSeconds(delay)
+		return pluginResponse, &statusError{
+			status:     req.Config.RateLimitStatus,
+			err:        fmt.Errorf("too many login attempts, retry after %ds", retryAfter),
+			retryAfter: time.Duration(retryAfter) * time.Second,
+		}
+	}
+	reason, category := req.verify(user, req.password(pluginLoginContent.Metas))
+	if reason == "" {
+		reason, category = req.checkClientAddr(user, pluginLoginContent.ClientAddress)
+	}
+	if reason == "" {
+		reason, category = req.checkOTP(user, pluginLoginContent.Metas)
+	}
+	if reason != "" {
+		loginRejected.WithLabelValues(category).Inc()
+		pluginResponse.Reject = true
+		pluginResponse.RejectReason = reason
+		return pluginResponse, nil
+	}
+	loginAccepted.Inc()
+	pluginResponse.Unchange = true
+	return pluginResponse, nil
+}
+
+func handleNewProxy(req *opRequest) (plugin.Response, error) {
+	var pluginResponse plugin.Response
+	var pluginNewProxyContent plugin.NewProxyContent
+	err := req.decodeContent(&pluginNewProxyContent)
+	if err != nil {
+		return pluginResponse, err
+	}
+	user := req.userName(pluginNewProxyContent.User.User)
+	req.User = user
+	password := req.password(pluginNewProxyContent.User.Metas)
+	if req.skipEmpty(user, password) {
+		pluginResponse.Unchange = true
+		return pluginResponse, nil
+	}
+	reason, _ := req.verify(user, password)
+	if reason != "" {
+		pluginResponse.Reject = true
+		pluginResponse.RejectReason = reason
+		return pluginResponse, nil
+	}
+	// frpc prefixes proxy names with the user as configured, before lowercasing
+	if !strings.HasPrefix(pluginNewProxyContent.ProxyName, pluginNewProxyContent.User.User+".") {
+		switch req.Config.ProxyNamePolicy {
+		case ProxyNameOff:
+		case ProxyNameWarn:
+			req.Logger.Warn("proxy name is not prefixed with the user", "user", user, "proxy_name", pluginNewProxyContent.ProxyName)
+		default:
+			pluginResponse.Reject = true
+			pluginResponse.RejectReason = fmt.Sprintf("proxy name `%s` must be prefixed with `%s.`", pluginNewProxyContent.ProxyName, pluginNewProxyContent.User.User)
+			return pluginResponse, nil
+		}
+	}
+	var policy *Policy
+	if ps, ok := req.Store.(PolicyStore); ok {
+		policy = ps.Policy(user)
+	}
+	reason = policy.checkNewProxy(&pluginNewProxyContent)
+	if reason != "" {
+		pluginResponse.Reject = true
+		pluginResponse.RejectReason = reason
+		return pluginResponse, nil
+	}
+	var content map[string]interface{}
+	if policy != nil && policy.Bandwidth != "" {
+		content, err = withBandwidthLimit(req.Content, policy.Bandwidth)
+		if err != nil {
+			return pluginResponse, &statusError{status: http.StatusBadRequest, err: err}
+		}
+	}
+	limit := policy.maxProxies(req.Config.MaxProxies)
+	if !req.Proxies.Acquire(user, pluginNewProxyContent.ProxyName, limit) {
+		pluginResponse.Reject = true
+		pluginResponse.RejectReason = fmt.Sprintf("user `%s` has reached the limit of %d proxies", user, limit)
+		return pluginResponse, nil
+	}
+	// frps only applies a rewritten content when Unchange is false
+	if content != nil {
+		pluginResponse.Content = content
+		return pluginResponse, nil
+	}
+	pluginResponse.Unchange = true
+	return pluginResponse, nil
+}
+
+// withBandwidthLimit returns the NewProxy content with the bandwidth limit
+// set, enforced by frps 0.48.0 or newer. The content is rewritten as a
+// generic object since msg.NewProxy of the frp version this module builds
+// against has no such fields, and so that other fields unknown to it are
+// passed back to frps as is. Older frps versions drop the fields.
+func withBandwidthLimit(content json.RawMessage, bandwidth string) (map[string]interface{}, error) {
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	raw["bandwidth_limit"] = bandwidth
+	raw["bandwidth_limit_mode"] = "server"
+	return raw, nil
+}
+
+func handleCloseProxy(req *opRequest) (plugin.Response, error) {
+	var pluginResponse plugin.Response
+	var pluginCloseProxyContent plugin.CloseProxyContent
+	err := req.decodeContent(&pluginCloseProxyContent)
+	if err != nil {
+		return pluginResponse, err
+	}
+	req.User = req.userName(pluginCloseProxyContent.User.User)
+	req.Proxies.Release(req.User, pluginCloseProxyContent.ProxyName)
+	pluginResponse.Unchange = true
+	return pluginResponse, nil
+}
+
+// handlePing checks the credentials of a connected user again on every
+// heartbeat, so that removed, changed or expired credentials also end the
+// sessions logged in with them.
+func handlePing(req *opRequest) (plugin.Response, error) {
+	var pluginResponse plugin.Response
+	var pluginPingContent plugin.PingContent
+	err := req.decodeContent(&pluginPingContent)
+	if err != nil {
+		return pluginResponse, err
+	}
+	user := req.userName(pluginPingContent.User.User)
+	req.User = user
+	password := req.password(pluginPingContent.User.Metas)
+	if req.skipEmpty(user, password) {
+		pluginResponse.Unchange = true
+		return pluginResponse, nil
+	}
+	reason, _ := req.verify(user, password)
+	if reason != "" {
+		pluginResponse.Reject = true
+		pluginResponse.RejectReason = reason
+		return pluginResponse, nil
+	}
+	pluginResponse.Unchange = true
+	return pluginResponse, nil
+}
+
+// handleNewUserConn checks the credentials of the user owning the proxy on
+// every user connection when CheckUserConn is set, so that a revoked user
+// is cut off on the next connection rather than the next heartbeat.
+func handleNewUserConn(req *opRequest) (plugin.Response, error) {
+	var pluginResponse plugin.Response
+	var pluginNewUserConnContent plugin.NewUserConnContent
+	err := req.decodeContent(&pluginNewUserConnContent)
+	if err != nil {
+		return pluginResponse, err
+	}
+	user := req.userName(pluginNewUserConnContent.User.User)
+	req.User = user
+	password := req.password(pluginNewUserConnContent.User.Metas)
+	if req.Config.CheckUserConn && !req.skipEmpty(user, password) {
+		reason, _ := req.verify(user, password)
+		if reason != "" {
+			pluginResponse.Reject = true
+			pluginResponse.RejectReason = reason
+			return pluginResponse, nil
+		}
+	}
+	pluginResponse.Unchange = true
+	return pluginResponse, nil
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	status := map[string]interface{}{
+		"status":  "ok",
+		"version": Version,
+	}
+	if uc, ok := s.store.(userCounter); ok {
+		status["users"] = uc.Len()
+	}
+	if authFile := s.authFile(); authFile != "" {
+		status["auth_file"] = authFile
+	}
+	if s.maintenanceMessage() != "" {
+		status["maintenance"] = true
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleReadyz answers 200 once the credentials are loaded and the backend
+// of the store, if any, is reachable, and 503 otherwise. /healthz only tells
+// that the process is alive.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.ready.Load() {
+		writeMsg(w, http.StatusServiceUnavailable, "credentials not loaded")
+		return
+	}
+	if p, ok := unwrapStore(s.store).(pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			writeMsg(w, http.StatusServiceUnavailable, fmt.Sprintf("auth backend unreachable: %v", err))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// buildInfo is the body of /version.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, buildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		writeMsg(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(resp)
+}
+
+func writeMsg(w http.ResponseWriter, status int, msg string) {
+	resp, _ := json.Marshal(map[string]string{"msg": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(resp)
+}
+
+// allowRemoteAddr checks the address of a plugin request against the
+// global deny and allow lists.
+func (s *Server) allowRemoteAddr(remoteAddr string) bool {
+	if len(s.allowNets) == 0 && len(s.denyNets) == 0 {
+		return true
+	}
+	ip, err := parseAddr(remoteAddr)
+	if err != nil {
+		return false
+	}
+	if s.denyNets.Contains(ip) {
+		return false
+	}
+	return len(s.allowNets) == 0 || s.allowNets.Contains(ip)
+}
+
+// retryAfterSeconds rounds delay up to whole seconds, at least one, as sent
+// in Retry-After.
+func retryAfterSeconds(delay time.Duration) int {
+	seconds := int((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+func checkBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// clientIP returns the ip of the client of r, nil if it cannot be parsed.
+// Forwarding headers are only honored when the peer is one of the trusted
+// proxies, since any client can send them: X-Real-IP if TrustForwarded is
+// set, otherwise X-Forwarded-For walked from the right, where the first hop
+// which is not a trusted proxy is the client.
+func (s *Server) clientIP(r *http.Request) net.IP {
+	peer, err := parseAddr(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	if !s.trustedProxies.Contains(peer) {
+		return net.IP(peer.AsSlice())
+	}
+	if s.cfg.TrustForwarded {
+		if realIP, err := parseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return net.IP(realIP.AsSlice())
+		}
+	}
+	client := peer
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop
+		if !s.trustedProxies.Contains(hop) {
+			break
+		}
+	}
+	return net.IP(client.AsSlice())
+}
+
+// clientAddr is clientIP as a string, the remote address when it cannot be
+// parsed.
+func (s *Server) clientAddr(r *http.Request) string {
+	if ip := s.clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
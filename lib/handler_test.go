@@ -0,0 +1,733 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server on a free local port, stopped when the
+// test ends.
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	if cfg.BindAddress == "" {
+		cfg.BindAddress = "127.0.0.1:0"
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	t.Cleanup(func() { _ = s.Stop(context.Background()) })
+	return s
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := parseIPNets("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("parseIPNets() error = %v", err)
+	}
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string
+		realIP         string
+		trustForwarded bool
+		want           string
+	}{
+		{name: "no headers", remoteAddr: "203.0.113.1:1234", want: "203.0.113.1"},
+		{name: "untrusted peer spoofing xff", remoteAddr: "203.0.113.1:1234", forwardedFor: []string{"1.1.1.1"}, want: "203.0.113.1"},
+		{name: "untrusted peer spoofing x-real-ip", remoteAddr: "203.0.113.1:1234", realIP: "1.1.1.1", trustForwarded: true, want: "203.0.113.1"},
+		{name: "trusted peer without xff", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "trusted peer", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "multi hop skips trusted proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.1.1.1, 198.51.100.7, 192.168.1.1, 10.0.0.2"}, want: "198.51.100.7"},
+		{name: "multi hop ignores spoofed left hops", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.1.1.1, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "several xff headers", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.1.1.1", "198.51.100.7, 10.0.0.3"}, want: "198.51.100.7"},
+		{name: "only trusted hops", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "invalid hop stops the walk", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"1.1.1.1, junk, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "ipv6 peer", remoteAddr: "[2001:db8::1]:1234", forwardedFor: []string{"1.1.1.1"}, want: "2001:db8::1"},
+		{name: "x-real-ip from trusted peer", remoteAddr: "10.0.0.1:1234", realIP: "198.51.100.7", trustForwarded: true, want: "198.51.100.7"},
+		{name: "x-real-ip ignored without trust forwarded", remoteAddr: "10.0.0.1:1234", realIP: "198.51.100.7", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: Config{TrustForwarded: tt.trustForwarded}, trustedProxies: trustedProxies}
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := s.clientIP(r); got.String() != tt.want {
+				t.Errorf("clientIP() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+	s := &Server{}
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "not an address"
+	if got := s.clientIP(r); got != nil {
+		t.Errorf("clientIP() = %v, want nil", got)
+	}
+	if got := s.clientAddr(r); got != r.RemoteAddr {
+		t.Errorf("clientAddr() = %q, want %q", got, r.RemoteAddr)
+	}
+}
+
+func TestNewServerTrustForwardedRequiresTrustedProxies(t *testing.T) {
+	_, err := NewServer(Config{AuthData: "alice=x", BindAddress: "127.0.0.1:0", PasswordMetaKey: "password", TrustForwarded: true})
+	if err == nil {
+		t.Fatal("NewServer() error = nil, want error")
+	}
+}
+
+// postPlugin sends a plugin request for op with the JSON content to s.
+func postPlugin(t *testing.T, s *Server, op, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := `{"version":"` + plugin.APIVersion + `","op":"` + op + `","content":` + content + `}`
+	r := httptest.NewRequest(http.MethodPost, "/handler", strings.NewReader(body))
+	r.RemoteAddr = "203.0.113.1:1234"
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+// decodeResponse decodes the plugin response of a 200 answer.
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) plugin.Response {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	var resp plugin.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response error = %v", err)
+	}
+	return resp
+}
+
+func TestPasswordMetaKey(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", PasswordMetaKey: "token"})
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"token":"x"}}`)); resp.Reject {
+		t.Errorf("login with the custom key rejected: %s", resp.RejectReason)
+	}
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`)); !resp.Reject {
+		t.Error("login with the default key accepted, want rejected")
+	}
+	s = newTestServer(t, Config{AuthData: "alice=x"})
+	if s.cfg.PasswordMetaKey != DefaultPasswordMetaKey {
+		t.Errorf("PasswordMetaKey = %q, want %q", s.cfg.PasswordMetaKey, DefaultPasswordMetaKey)
+	}
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`)); resp.Reject {
+		t.Errorf("login with the default key rejected: %s", resp.RejectReason)
+	}
+	for _, key := range []string{" ", "pass word", "token\n"} {
+		if _, err := NewServer(Config{AuthData: "alice=x", BindAddress: "127.0.0.1:0", PasswordMetaKey: key}); err == nil {
+			t.Errorf("NewServer() with password key %q error = nil, want error", key)
+		}
+	}
+}
+
+func TestErrorResponsesAreJSON(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x"})
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		encoding string
+		status   int
+	}{
+		{name: "method not allowed", method: http.MethodGet, status: http.StatusMethodNotAllowed},
+		{name: "malformed body", method: http.MethodPost, body: `{"op":`, status: http.StatusBadRequest},
+		{name: "missing op", method: http.MethodPost, body: `{"content":{}}`, status: http.StatusBadRequest},
+		{name: "message with quote and backslash", method: http.MethodPost, body: `{}`, encoding: `a"b\c`, status: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/handler", strings.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["msg"] == "" {
+				t.Errorf("body %s is not a json message: %v", w.Body, err)
+			}
+		})
+	}
+	w := postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("plugin response Content-Type = %q, want application/json", ct)
+	}
+}
+
+func TestEndpointToken(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", AuthToken: "token"})
+	body := `{"version":"` + plugin.APIVersion + `","op":"Login","content":{"user":"alice","metas":{"password":"x"}}}`
+	for _, tt := range []struct {
+		authorization string
+		status        int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"token", http.StatusUnauthorized},
+		{"Bearer token", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/handler", strings.NewReader(body))
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Authorization %q status = %d, want %d", tt.authorization, w.Code, tt.status)
+		}
+	}
+}
+
+func newProxyContent(proxyName string) string {
+	return `{"user":{"user":"alice","metas":{"password":"x"}},"proxy_name":"` + proxyName + `","proxy_type":"tcp","remote_port":8080}`
+}
+
+func TestMaxProxies(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x;max_proxies=2", MaxProxies: 1})
+	for _, name := range []string{"alice.a", "alice.b"} {
+		if resp := decodeResponse(t, postPlugin(t, s, plugin.OpNewProxy, newProxyContent(name))); resp.Reject {
+			t.Fatalf("NewProxy %s rejected: %s", name, resp.RejectReason)
+		}
+	}
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpNewProxy, newProxyContent("alice.c"))); !resp.Reject {
+		t.Error("NewProxy past the limit accepted, want rejected")
+	}
+	// a proxy registered again, e.g. after a reconnect, is not counted twice
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpNewProxy, newProxyContent("alice.a"))); resp.Reject {
+		t.Errorf("NewProxy of an active proxy rejected: %s", resp.RejectReason)
+	}
+	postPlugin(t, s, plugin.OpCloseProxy, `{"user":{"user":"alice"},"proxy_name":"alice.a"}`)
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpNewProxy, newProxyContent("alice.c"))); resp.Reject {
+		t.Errorf("NewProxy after CloseProxy rejected: %s", resp.RejectReason)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", MaxBodyBytes: 1024})
+	content := `{"user":"alice","metas":{"password":"x","pad":"` + strings.Repeat("a", 2048) + `"}}`
+	if w := postPlugin(t, s, plugin.OpLogin, content); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body status = %d, want 413", w.Code)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte(`{"op":"Login","content":{"pad":"` + strings.Repeat("a", 256<<10) + `"}}`))
+	_ = gz.Close()
+	if compressed.Len() > 1024 {
+		t.Fatalf("compressed body of %d bytes, want it within the limit", compressed.Len())
+	}
+	r := httptest.NewRequest(http.MethodPost, "/handler", &compressed)
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized gzip body status = %d, want 413", w.Code)
+	}
+
+	if w := postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`); w.Code != http.StatusOK {
+		t.Errorf("small body status = %d, want 200", w.Code)
+	}
+}
+
+func TestStrictHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		strictHTTP bool
+		op         string
+		content    string
+		status     int
+		reject     bool
+	}{
+		{name: "lenient accept", op: plugin.OpLogin, content: `{"user":"alice","metas":{"password":"x"}}`, status: http.StatusOK},
+		{name: "lenient reject", op: plugin.OpLogin, content: `{"user":"alice","metas":{"password":"y"}}`, status: http.StatusOK, reject: true},
+		{name: "lenient unsupported op", op: "Unknown", content: `{}`, status: http.StatusOK, reject: true},
+		{name: "strict accept", strictHTTP: true, op: plugin.OpLogin, content: `{"user":"alice","metas":{"password":"x"}}`, status: http.StatusOK},
+		{name: "strict reject", strictHTTP: true, op: plugin.OpLogin, content: `{"user":"alice","metas":{"password":"y"}}`, status: http.StatusForbidden, reject: true},
+		{name: "strict unsupported op", strictHTTP: true, op: "Unknown", content: `{}`, status: http.StatusForbidden, reject: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", StrictHTTP: tt.strictHTTP})
+			w := postPlugin(t, s, tt.op, tt.content)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			// the body is the plugin response either way
+			var resp plugin.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response error = %v", err)
+			}
+			if resp.Reject != tt.reject || (tt.reject && resp.RejectReason == "") {
+				t.Errorf("reject = %v (%q), want %v with a reason", resp.Reject, resp.RejectReason, tt.reject)
+			}
+		})
+	}
+}
+
+func TestAllowDenyCIDRs(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", AllowCIDRs: "10.0.0.0/8, 2001:db8::/32", DenyCIDRs: "10.0.0.5/32"})
+	tests := []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"10.1.2.3:1234", http.StatusOK},
+		{"10.0.0.5:1234", http.StatusForbidden},
+		{"192.168.1.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"[2001:db9::1]:1234", http.StatusForbidden},
+	}
+	body := `{"version":"` + plugin.APIVersion + `","op":"Login","content":{"user":"alice","metas":{"password":"x"}}}`
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/handler", strings.NewReader(body))
+		r.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("request from %s status = %d, want %d", tt.remoteAddr, w.Code, tt.status)
+		}
+	}
+	if _, err := NewServer(Config{AuthData: "alice=x", BindAddress: "127.0.0.1:0", DenyCIDRs: "10.0.0.0/33"}); err == nil {
+		t.Error("NewServer() with an invalid cidr error = nil, want error")
+	}
+}
+
+func TestPluginRequestValidation(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x"})
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		reject   bool
+		unchange bool
+	}{
+		{
+			name:     "NewWorkConn",
+			body:     `{"version":"0.1.0","op":"NewWorkConn","content":{"user":{"user":"alice","metas":{"password":"x"},"run_id":"5f1d9c2e"},"run_id":"5f1d9c2e","privilege_key":"a1b2c3","timestamp":1700000000}}`,
+			status:   http.StatusOK,
+			unchange: true,
+		},
+		{name: "unknown op", body: `{"version":"0.1.0","op":"DeleteEverything","content":{}}`, status: http.StatusOK, reject: true},
+		{name: "missing op", body: `{"version":"0.1.0","content":{}}`, status: http.StatusBadRequest},
+		{name: "other version", body: `{"version":"9.9.9","op":"Login","content":{"user":"alice","metas":{"password":"x"}}}`, status: http.StatusOK, unchange: true},
+		{name: "content not an object", body: `{"version":"0.1.0","op":"Login","content":"alice"}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/handler", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			resp := decodeResponse(t, w)
+			if resp.Reject != tt.reject || resp.Unchange != tt.unchange {
+				t.Errorf("reject, unchange = %v, %v, want %v, %v", resp.Reject, resp.Unchange, tt.reject, tt.unchange)
+			}
+		})
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x"})
+	// as sent by frps on every heartbeat of frpc
+	ping := func(password string) string {
+		return `{"user":{"user":"alice","metas":{"password":"` + password + `"},"run_id":"5f1d9c2e"},"privilege_key":"9e107d9d372bb6826bd81d3542a419d6","timestamp":1700000000}`
+	}
+	tests := []struct {
+		name    string
+		content string
+		reject  bool
+	}{
+		{name: "valid credentials", content: ping("x")},
+		{name: "changed password", content: ping("old"), reject: true},
+		{name: "removed user", content: `{"user":{"user":"bob","metas":{"password":"x"},"run_id":"5f1d9c2e"},"timestamp":1700000000}`, reject: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := decodeResponse(t, postPlugin(t, s, plugin.OpPing, tt.content))
+			if resp.Reject != tt.reject {
+				t.Errorf("reject = %v (%s), want %v", resp.Reject, resp.RejectReason, tt.reject)
+			}
+			if !tt.reject && !resp.Unchange {
+				t.Error("unchange = false, want true")
+			}
+		})
+	}
+}
+
+func TestNewUserConn(t *testing.T) {
+	userConn := func(user, password string) string {
+		return `{"user":{"user":"` + user + `","metas":{"password":"` + password + `"},"run_id":"5f1d9c2e"},"proxy_name":"` + user + `.web","proxy_type":"tcp","remote_addr":"198.51.100.7:50000"}`
+	}
+	tests := []struct {
+		name          string
+		checkUserConn bool
+		content       string
+		reject        bool
+	}{
+		{name: "unchecked valid", content: userConn("alice", "x")},
+		{name: "unchecked revoked", content: userConn("alice", "old")},
+		{name: "checked valid", checkUserConn: true, content: userConn("alice", "x")},
+		{name: "checked revoked", checkUserConn: true, content: userConn("alice", "old"), reject: true},
+		{name: "checked removed user", checkUserConn: true, content: userConn("bob", "x"), reject: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", CheckUserConn: tt.checkUserConn})
+			resp := decodeResponse(t, postPlugin(t, s, plugin.OpNewUserConn, tt.content))
+			if resp.Reject != tt.reject {
+				t.Errorf("reject = %v (%s), want %v", resp.Reject, resp.RejectReason, tt.reject)
+			}
+		})
+	}
+}
+
+func TestGenericRejectMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		generic   bool
+		identical bool
+	}{
+		{name: "default", generic: false, identical: false},
+		{name: "generic", generic: true, identical: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", GenericRejectMessage: tt.generic})
+			unknown := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"mallory","metas":{"password":"x"}}`))
+			wrong := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"y"}}`))
+			if !unknown.Reject || !wrong.Reject {
+				t.Fatalf("reject = %v, %v, want both rejected", unknown.Reject, wrong.Reject)
+			}
+			if (unknown.RejectReason == wrong.RejectReason) != tt.identical {
+				t.Errorf("reasons %q and %q, want identical %v", unknown.RejectReason, wrong.RejectReason, tt.identical)
+			}
+			if tt.generic && unknown.RejectReason != genericRejectMessage {
+				t.Errorf("reason = %q, want %q", unknown.RejectReason, genericRejectMessage)
+			}
+		})
+	}
+}
+
+// blockingStore is a backend which hangs until release is closed or the
+// verification is given up.
+type blockingStore struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStore() *blockingStore {
+	return &blockingStore{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s *blockingStore) Verify(user, password string) (bool, error) {
+	return s.VerifyContext(context.Background(), user, password)
+}
+
+func (s *blockingStore) VerifyContext(ctx context.Context, user, password string) (bool, error) {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+	select {
+	case <-s.release:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (s *blockingStore) Reload() error {
+	return nil
+}
+
+func TestBackendTimeout(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", BackendTimeout: 50 * time.Millisecond})
+	s.store = newBlockingStore()
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`) }()
+	var resp plugin.Response
+	select {
+	case w := <-done:
+		resp = decodeResponse(t, w)
+	case <-time.After(5 * time.Second):
+		t.Fatal("login not given up after the backend timeout")
+	}
+	if !resp.Reject || resp.RejectReason != "auth backend unavailable" {
+		t.Errorf("login = %v %q, want rejected as unavailable", resp.Reject, resp.RejectReason)
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		strictJSON bool
+		op         string
+		content    string
+		status     int
+	}{
+		{name: "lenient unknown field", op: plugin.OpLogin, content: `{"user":"alice","metas":{"password":"x"},"new_field":1}`, status: http.StatusOK},
+		{name: "strict unknown field", strictJSON: true, op: plugin.OpLogin, content: `{"user":"alice","metas":{"password":"x"},"new_field":1}`, status: http.StatusBadRequest},
+		{name: "lenient missing metas", op: plugin.OpPing, content: `{"user":{"user":"alice"}}`, status: http.StatusOK},
+		{name: "strict missing metas", strictJSON: true, op: plugin.OpPing, content: `{"user":{"user":"alice"}}`, status: http.StatusBadRequest},
+		{name: "strict missing proxy name", strictJSON: true, op: plugin.OpNewProxy, content: `{"user":{"user":"alice","metas":{"password":"x"}},"proxy_type":"tcp"}`, status: http.StatusBadRequest},
+		{name: "strict complete", strictJSON: true, op: plugin.OpNewProxy, content: newProxyContent("alice.web"), status: http.StatusOK},
+		{name: "lenient wrong type", op: plugin.OpLogin, content: `{"user":1}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", StrictJSON: tt.strictJSON})
+			if w := postPlugin(t, s, tt.op, tt.content); w.Code != tt.status {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	for _, strict := range []bool{false, true} {
+		s := newTestServer(t, Config{AuthData: "alice=x", StrictJSON: strict})
+		body := `{"version":"` + plugin.APIVersion + `","op":"Login","content":{"user":"alice","metas":{"password":"x"}}} {}`
+		r := httptest.NewRequest(http.MethodPost, "/handler", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("data after the request with strict %v status = %d, want 400", strict, w.Code)
+		}
+	}
+}
+
+func TestNewProxyBandwidthLimit(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x;bandwidth=1mb\nbob=y"})
+	content := func(user, password string) string {
+		return `{"user":{"user":"` + user + `","metas":{"password":"` + password + `"}},"proxy_name":"` + user + `.web","proxy_type":"tcp","remote_port":6000,"future_field":{"n":12345678901234567890}}`
+	}
+	w := postPlugin(t, s, plugin.OpNewProxy, content("alice", "x"))
+	var resp struct {
+		Reject   bool                   `json:"reject"`
+		Unchange bool                   `json:"unchange"`
+		Content  map[string]interface{} `json:"content"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response error = %v, body %s", err, w.Body)
+	}
+	if resp.Reject || resp.Unchange {
+		t.Fatalf("response = %s, want a rewritten content", w.Body)
+	}
+	if resp.Content["bandwidth_limit"] != "1MB" || resp.Content["bandwidth_limit_mode"] != "server" {
+		t.Errorf("content = %v, want the bandwidth limit set", resp.Content)
+	}
+	if resp.Content["proxy_name"] != "alice.web" {
+		t.Errorf("content = %v, want the other fields kept", resp.Content)
+	}
+	if !strings.Contains(w.Body.String(), "12345678901234567890") {
+		t.Errorf("body = %s, want unknown fields and numbers passed back as is", w.Body)
+	}
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpNewProxy, content("bob", "y"))); !resp.Unchange || resp.Content != nil {
+		t.Errorf("response without a bandwidth policy = %+v, want unchanged", resp)
+	}
+}
+
+func TestEmptyUserOnlyRejectedOnLogin(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", CheckUserConn: true})
+	tests := []struct {
+		op      string
+		content string
+		reject  bool
+	}{
+		{op: plugin.OpLogin, content: `{"user":"","metas":{"password":"x"}}`, reject: true},
+		{op: plugin.OpPing, content: `{"user":{"user":"","metas":{},"run_id":""},"timestamp":1700000000}`},
+		{op: plugin.OpPing, content: `{"timestamp":1700000000}`},
+		{op: plugin.OpNewProxy, content: `{"user":{"user":"","metas":{}},"proxy_name":"web","proxy_type":"tcp"}`},
+		{op: plugin.OpNewUserConn, content: `{"user":{"user":"","metas":{}},"proxy_name":"web","proxy_type":"tcp"}`},
+	}
+	for _, tt := range tests {
+		resp := decodeResponse(t, postPlugin(t, s, tt.op, tt.content))
+		if resp.Reject != tt.reject {
+			t.Errorf("%s %s reject = %v (%s), want %v", tt.op, tt.content, resp.Reject, resp.RejectReason, tt.reject)
+		}
+		if !tt.reject && !resp.Unchange {
+			t.Errorf("%s %s unchange = false, want true", tt.op, tt.content)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", MaxConcurrent: 1})
+	store := newBlockingStore()
+	s.store = store
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`) }()
+	select {
+	case <-store.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first login did not reach the backend")
+	}
+
+	w := postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("login over the limit status = %d, Retry-After %q, want 503 and 1", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(store.release)
+	if resp := decodeResponse(t, <-done); resp.Reject {
+		t.Errorf("first login rejected: %s", resp.RejectReason)
+	}
+	// the slot is free again
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`)); resp.Reject {
+		t.Errorf("login after the first finished rejected: %s", resp.RejectReason)
+	}
+}
+
+func TestProxyNamePolicy(t *testing.T) {
+	tests := []struct {
+		policy    string
+		proxyName string
+		reject    bool
+	}{
+		{policy: "", proxyName: "alice.web"},
+		{policy: "", proxyName: "bob.web", reject: true},
+		{policy: "", proxyName: "aliceweb", reject: true},
+		{policy: ProxyNameEnforce, proxyName: "bob.web", reject: true},
+		{policy: ProxyNameWarn, proxyName: "bob.web"},
+		{policy: ProxyNameOff, proxyName: "bob.web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.proxyName, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", ProxyNamePolicy: tt.policy})
+			resp := decodeResponse(t, postPlugin(t, s, plugin.OpNewProxy, newProxyContent(tt.proxyName)))
+			if resp.Reject != tt.reject {
+				t.Errorf("reject = %v (%s), want %v", resp.Reject, resp.RejectReason, tt.reject)
+			}
+		})
+	}
+	if _, err := NewServer(Config{AuthData: "alice=x", BindAddress: "127.0.0.1:0", ProxyNamePolicy: "strict"}); err == nil {
+		t.Error("NewServer() with an unknown proxy name policy error = nil, want error")
+	}
+}
+
+func TestMissingMetas(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", CheckUserConn: true})
+	for _, content := range []string{
+		`{"user":"alice"}`,
+		`{"user":"alice","metas":null}`,
+		`{"user":"alice","metas":{}}`,
+	} {
+		resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, content))
+		if !resp.Reject || resp.RejectReason != "user or meta password can not be empty" {
+			t.Errorf("Login %s = %v %q, want rejected for the empty password", content, resp.Reject, resp.RejectReason)
+		}
+	}
+	for _, op := range []string{plugin.OpNewProxy, plugin.OpPing, plugin.OpNewUserConn} {
+		if w := postPlugin(t, s, op, `{"user":{"user":"alice"}}`); w.Code != http.StatusOK {
+			t.Errorf("%s without metas status = %d, want 200", op, w.Code)
+		}
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	defer func(version, commit, buildDate string) { Version, Commit, BuildDate = version, commit, buildDate }(Version, Commit, BuildDate)
+	Version, Commit, BuildDate = "1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+
+	s := newTestServer(t, Config{AuthData: "alice=x", VersionEndpoint: true})
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var got buildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode body error = %v", err)
+	}
+	if want := (buildInfo{Version: "1.2.3", Commit: "abc1234", BuildDate: "2024-01-02T03:04:05Z", GoVersion: runtime.Version()}); got != want {
+		t.Errorf("/version = %+v, want %+v", got, want)
+	}
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/version", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /version status = %d, want 405", w.Code)
+	}
+
+	// without the endpoint /version is a plugin path like any other
+	s = newTestServer(t, Config{AuthData: "alice=x"})
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusMethodNotAllowed || strings.Contains(w.Body.String(), "abc1234") {
+		t.Errorf("disabled /version status = %d, body %s, want 405 without the build information", w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	readyz := func(s *Server) int {
+		w := httptest.NewRecorder()
+		s.handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+	if code := readyz(&Server{}); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before the first load status = %d, want 503", code)
+	}
+
+	filename := writeTestFile(t, "tokens", "alice=x\n")
+	s := newTestServer(t, Config{AuthFile: filename})
+	tests := []struct {
+		name   string
+		change func() error
+		status int
+	}{
+		{name: "loaded", change: func() error { return nil }, status: http.StatusOK},
+		{name: "failed reload", change: func() error { return os.Remove(filename) }, status: http.StatusServiceUnavailable},
+		{name: "reload after the failure", change: func() error { return os.WriteFile(filename, []byte("alice=y\n"), 0600) }, status: http.StatusOK},
+		{name: "empty reload keeps the users", change: func() error { return os.WriteFile(filename, nil, 0600) }, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); err != nil {
+				t.Fatalf("change auth file error = %v", err)
+			}
+			_ = s.reloadStore()
+			if code := readyz(s); code != tt.status {
+				t.Errorf("/readyz status = %d, want %d", code, tt.status)
+			}
+		})
+	}
+
+	// a backend the store can not reach
+	db := newTestServer(t, Config{DBPath: filepath.Join(t.TempDir(), "users.db")})
+	if code := readyz(db); code != http.StatusOK {
+		t.Errorf("/readyz with the database open status = %d, want 200", code)
+	}
+	_ = unwrapStore(db.store).(*SQLiteStore).Close()
+	if code := readyz(db); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with the database closed status = %d, want 503", code)
+	}
+}
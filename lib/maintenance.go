@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// DefaultMaintenanceMessage is the reject reason of logins in maintenance
+// mode unless configured otherwise.
+const DefaultMaintenanceMessage = "server is under maintenance"
+
+// maintenanceMessage returns the reject reason of logins when the server is
+// in maintenance mode, set through the admin api or by the maintenance
+// file, and an empty string otherwise.
+func (s *Server) maintenanceMessage() string {
+	if !s.maintenance.Load() && !s.maintenanceFileExists() {
+		return ""
+	}
+	if s.cfg.MaintenanceMessage == "" {
+		return DefaultMaintenanceMessage
+	}
+	return s.cfg.MaintenanceMessage
+}
+
+func (s *Server) maintenanceFileExists() bool {
+	if s.cfg.MaintenanceFile == "" {
+		return false
+	}
+	_, err := os.Stat(s.cfg.MaintenanceFile)
+	return err == nil
+}
+
+// adminMaintenance is the body of POST /maintenance and GET /maintenance.
+// File reports whether the maintenance file exists, which the api can not
+// turn off.
+type adminMaintenance struct {
+	Enabled bool `json:"enabled"`
+	File    bool `json:"file,omitempty"`
+}
+
+func (s *Server) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		byteData, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, defaultMaxBodyBytes))
+		if err != nil {
+			writeMsg(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var maintenance adminMaintenance
+		err = json.Unmarshal(byteData, &maintenance)
+		if err != nil {
+			writeMsg(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if s.maintenance.Swap(maintenance.Enabled) != maintenance.Enabled {
+			s.logger.Info("maintenance mode changed", "enabled", maintenance.Enabled)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeMsg(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, adminMaintenance{
+		Enabled: s.maintenance.Load(),
+		File:    s.maintenanceFileExists(),
+	})
+}
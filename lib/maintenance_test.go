@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"encoding/json"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	maintenanceFile := filepath.Join(t.TempDir(), "maintenance")
+	s := newTestServer(t, Config{AuthData: "alice=x", AdminAddr: "127.0.0.1:0", AdminToken: "admin", MaintenanceFile: maintenanceFile, MaintenanceMessage: "back at noon"})
+	login := func() plugin.Response {
+		return decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`))
+	}
+	maintenance := func(method, body string) adminMaintenance {
+		w := adminRequest(t, s, method, "/maintenance", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s /maintenance status = %d, want 200, body %s", method, w.Code, w.Body)
+		}
+		var got adminMaintenance
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode body error = %v", err)
+		}
+		return got
+	}
+
+	if resp := login(); resp.Reject {
+		t.Fatalf("login rejected before maintenance: %s", resp.RejectReason)
+	}
+	if got := maintenance(http.MethodPost, `{"enabled":true}`); got != (adminMaintenance{Enabled: true}) {
+		t.Errorf("POST /maintenance = %+v, want enabled", got)
+	}
+	if resp := login(); !resp.Reject || resp.RejectReason != "back at noon" {
+		t.Errorf("login in maintenance = %v %q, want rejected with the message", resp.Reject, resp.RejectReason)
+	}
+	// other ops keep working for connected clients
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpPing, `{"user":{"user":"alice","metas":{"password":"x"}}}`)); resp.Reject {
+		t.Errorf("Ping rejected in maintenance: %s", resp.RejectReason)
+	}
+	if got := maintenance(http.MethodPost, `{"enabled":false}`); got != (adminMaintenance{}) {
+		t.Errorf("POST /maintenance = %+v, want disabled", got)
+	}
+	if resp := login(); resp.Reject {
+		t.Errorf("login rejected after maintenance: %s", resp.RejectReason)
+	}
+
+	if err := os.WriteFile(maintenanceFile, nil, 0600); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	if got := maintenance(http.MethodGet, ""); got != (adminMaintenance{File: true}) {
+		t.Errorf("GET /maintenance = %+v, want the file reported", got)
+	}
+	if resp := login(); !resp.Reject {
+		t.Error("login accepted while the maintenance file exists, want rejected")
+	}
+	if err := os.Remove(maintenanceFile); err != nil {
+		t.Fatalf("remove error = %v", err)
+	}
+	if resp := login(); resp.Reject {
+		t.Errorf("login rejected after the maintenance file was removed: %s", resp.RejectReason)
+	}
+
+	if w := adminRequest(t, s, http.MethodPost, "/maintenance", `{`); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed body status = %d, want 400", w.Code)
+	}
+	if w := adminRequest(t, s, http.MethodDelete, "/maintenance", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /maintenance status = %d, want 405", w.Code)
+	}
+}
+
+func TestMaintenanceDefaultMessage(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x"})
+	s.maintenance.Store(true)
+	resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`))
+	if !resp.Reject || resp.RejectReason != DefaultMaintenanceMessage {
+		t.Errorf("login = %v %q, want rejected with %q", resp.Reject, resp.RejectReason, DefaultMaintenanceMessage)
+	}
+}
@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sort"
+)
+
+const metricsNamespace = "frp_multiuser"
+
+const (
+	rejectEmptyField         = "empty_field"
+	rejectInvalidCredentials = "invalid_credentials"
+	rejectBackendError       = "backend_error"
+	rejectRateLimited        = "rate_limited"
+	rejectExpired            = "expired"
+	rejectAddressNotAllowed  = "address_not_allowed"
+	rejectMaintenance        = "maintenance"
+	rejectDisabled           = "disabled"
+	rejectInvalidOTP         = "invalid_otp"
+)
+
+var (
+	loginAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_attempts_total",
+		Help:      "Total number of login attempts.",
+	})
+	loginAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_accepted_total",
+		Help:      "Total number of accepted logins.",
+	})
+	loginRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_rejected_total",
+		Help:      "Total number of rejected logins by reason.",
+	}, []string{"reason"})
+	reloadTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_reload_total",
+		Help:      "Total number of credential reloads.",
+	})
+	reloadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_reload_errors_total",
+		Help:      "Total number of failed credential reloads.",
+	})
+	lastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_last_reload_timestamp_seconds",
+		Help:      "Unix time of the last successful credential load.",
+	})
+)
+
+var activeProxiesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "active_proxies"),
+	"Number of active proxies by user.",
+	[]string{"user"}, nil,
+)
+
+// maxProxyMetricUsers bounds the user label of the active proxies.
+const maxProxyMetricUsers = 1000
+
+// proxyCollector exports the proxy counts of a proxyTracker. Only users with
+// active proxies are exported, which have passed verification, but glob
+// users and backend stores let any number of names do so. Only the
+// maxProxyMetricUsers users with the most proxies get their own series; the
+// proxies of the others are summed up with an empty user, which no user can
+// have.
+type proxyCollector struct {
+	proxies *proxyTracker
+}
+
+func (c proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeProxiesDesc
+}
+
+func (c proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	for user, count := range boundProxyCounts(c.proxies.Counts(), maxProxyMetricUsers) {
+		ch <- prometheus.MustNewConstMetric(activeProxiesDesc, prometheus.GaugeValue, float64(count), user)
+	}
+}
+
+// boundProxyCounts keeps the limit users with the most proxies, ties broken
+// by name, and sums up the others under the empty user.
+func boundProxyCounts(counts map[string]int, limit int) map[string]int {
+	if len(counts) <= limit {
+		return counts
+	}
+	users := make([]string, 0, len(counts))
+	for user := range counts {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if counts[users[i]] != counts[users[j]] {
+			return counts[users[i]] > counts[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	bounded := make(map[string]int, limit+1)
+	for i, user := range users {
+		if i < limit {
+			bounded[user] = counts[user]
+		} else {
+			bounded[""] += counts[user]
+		}
+	}
+	return bounded
+}
+
+func newMetricsHandler(store AuthStore, proxies *proxyTracker) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(loginAttempts, loginAccepted, loginRejected, reloadTotal, reloadErrors, lastReload, proxyCollector{proxies: proxies})
+	if uc, ok := store.(userCounter); ok {
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "users",
+			Help:      "Number of loaded users.",
+		}, func() float64 {
+			return float64(uc.Len())
+		}))
+	}
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
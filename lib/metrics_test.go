@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBoundProxyCounts(t *testing.T) {
+	counts := map[string]int{"alice": 3, "bob": 1, "carol": 2, "dave": 1}
+	if got := boundProxyCounts(counts, 4); !reflect.DeepEqual(got, counts) {
+		t.Errorf("boundProxyCounts() under the limit = %v, want %v", got, counts)
+	}
+	want := map[string]int{"alice": 3, "carol": 2, "": 2}
+	if got := boundProxyCounts(counts, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("boundProxyCounts() = %v, want %v", got, want)
+	}
+}
+
+func TestProxyCollectorBoundsUsers(t *testing.T) {
+	proxies := newProxyTracker()
+	for i := 0; i < maxProxyMetricUsers+10; i++ {
+		proxies.Acquire(fmt.Sprintf("ci-%d", i), "web", 0)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(proxyCollector{proxies: proxies})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("Gather() = %d families, want 1", len(families))
+	}
+	if n := len(families[0].GetMetric()); n != maxProxyMetricUsers+1 {
+		t.Errorf("exported %d series, want %d", n, maxProxyMetricUsers+1)
+	}
+}
+
+func TestAdminStatsJSON(t *testing.T) {
+	proxies := newProxyTracker()
+	proxies.Acquire("alice", "alice.web", 0)
+	proxies.Acquire("alice", "alice.ssh", 0)
+	proxies.Acquire("bob", "bob.web", 0)
+	proxies.Release("bob", "bob.web")
+	data, err := json.Marshal(adminStats{Proxies: proxies.Counts()})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if want := `{"proxies":{"alice":2}}`; string(data) != want {
+		t.Errorf("stats = %s, want %s", data, want)
+	}
+}
+
+func TestReloadCounters(t *testing.T) {
+	filename := writeTestFile(t, "tokens", "alice=x\n")
+	s := newTestServer(t, Config{AuthFile: filename})
+	total, errs := testutil.ToFloat64(reloadTotal), testutil.ToFloat64(reloadErrors)
+	if err := s.reloadStore(); err != nil {
+		t.Fatalf("reloadStore() error = %v", err)
+	}
+	if err := os.Remove(filename); err != nil {
+		t.Fatalf("remove error = %v", err)
+	}
+	if err := s.reloadStore(); err == nil {
+		t.Fatal("reloadStore() of a missing file error = nil, want error")
+	}
+	if got := testutil.ToFloat64(reloadTotal) - total; got != 2 {
+		t.Errorf("auth_reload_total grew by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(reloadErrors) - errs; got != 1 {
+		t.Errorf("auth_reload_errors_total grew by %v, want 1", got)
+	}
+}
@@ -0,0 +1,237 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// dummyPassword is compared against when a user does not exist, so that
+// unknown users and wrong passwords take a similar amount of time. It is
+// hashed with the scheme and parameters of the stored passwords by
+// dummyHash, since a hash takes far longer to check than plaintext.
+const dummyPassword = "frp-multiuser-dummy-password"
+
+// dummyHashes caches the hashes of dummyPassword by hashScheme.
+var dummyHashes sync.Map
+
+// dummyHash returns dummyPassword hashed like stored, or as is if stored is
+// plaintext. The hashes are made once per scheme and parameters.
+func dummyHash(stored string) string {
+	scheme := hashScheme(stored)
+	if scheme == "" {
+		return dummyPassword
+	}
+	if hash, ok := dummyHashes.Load(scheme); ok {
+		return hash.(string)
+	}
+	var hash string
+	if cost, err := bcrypt.Cost([]byte(stored)); err == nil {
+		hashBytes, err := bcrypt.GenerateFromPassword([]byte(dummyPassword), cost)
+		if err != nil {
+			return dummyPassword
+		}
+		hash = string(hashBytes)
+	} else {
+		params, _, key, _ := parseArgon2id(stored)
+		hash, err = hashArgon2id(dummyPassword, params, uint32(len(key)))
+		if err != nil {
+			return dummyPassword
+		}
+	}
+	actual, _ := dummyHashes.LoadOrStore(scheme, hash)
+	return actual.(string)
+}
+
+// hashScheme names the scheme and parameters of a stored password, which
+// set the time taken to check it, e.g. `bcrypt 10`. It is empty for
+// plaintext and malformed hashes.
+func hashScheme(stored string) string {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("bcrypt %d", cost)
+	case strings.HasPrefix(stored, "$argon2id$"):
+		params, _, key, ok := parseArgon2id(stored)
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf("argon2id m=%d,t=%d,p=%d,k=%d", params.memory, params.iterations, params.threads, len(key))
+	default:
+		return ""
+	}
+}
+
+// defaultDummyHash is the dummy hash while nothing is known of the stored
+// passwords: bcrypt with the default cost, as HashPassword writes them.
+var defaultDummyHash = sync.OnceValue(func() string {
+	hash, err := HashPassword(dummyPassword, "bcrypt", 0)
+	if err != nil {
+		return dummyPassword
+	}
+	return hash
+})
+
+// backendDummy gives the dummy hash of a store reading the passwords from a
+// backend one at a time, following the scheme of the last one read.
+type backendDummy struct {
+	hash atomic.Value
+}
+
+func (d *backendDummy) seen(stored string) {
+	d.hash.Store(dummyHash(stored))
+}
+
+func (d *backendDummy) get() string {
+	if hash, ok := d.hash.Load().(string); ok {
+		return hash
+	}
+	return defaultDummyHash()
+}
+
+// mapDummyHash returns the dummy hash for a set of stored passwords, hashed
+// with the scheme most of them use.
+func mapDummyHash(PasswordMap map[string][]string) string {
+	counts := make(map[string]int)
+	examples := make(map[string]string)
+	for _, passwords := range PasswordMap {
+		for _, stored := range passwords {
+			scheme := hashScheme(stored)
+			counts[scheme]++
+			examples[scheme] = stored
+		}
+	}
+	best := ""
+	for scheme, count := range counts {
+		if count > counts[best] || count == counts[best] && scheme < best {
+			best = scheme
+		}
+	}
+	return dummyHash(examples[best])
+}
+
+// verifyPassword checks a provided password against the stored value. The
+// stored value may be a hash with a recognized prefix; anything else is
+// treated as a plaintext password.
+func verifyPassword(stored, provided string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(provided)) == nil
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, provided)
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(provided)) == 1
+	}
+}
+
+// HashPassword hashes a password for the auth file with the given scheme,
+// bcrypt or argon2id. cost is the bcrypt cost, zero uses the default; it is
+// ignored by argon2id.
+func HashPassword(password, scheme string, cost int) (string, error) {
+	switch scheme {
+	case "", "bcrypt":
+		if cost == 0 {
+			cost = bcrypt.DefaultCost
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case "argon2id":
+		return hashPassword(password)
+	default:
+		return "", fmt.Errorf("unknown hash scheme `%s`", scheme)
+	}
+}
+
+// argon2id parameters used by hashPassword, the second recommended option of
+// RFC 9106.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// hashPassword hashes a password with argon2id into the PHC string format,
+// e.g. `$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>`, which verifyPassword
+// recognizes.
+func hashPassword(password string) (string, error) {
+	return hashArgon2id(password, argon2Params{memory: argon2Memory, iterations: argon2Time, threads: argon2Threads}, argon2KeyLen)
+}
+
+type argon2Params struct {
+	memory     uint32
+	iterations uint32
+	threads    uint8
+}
+
+func hashArgon2id(password string, params argon2Params, keyLen uint32) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.memory, params.iterations, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// parseArgon2id splits an argon2id hash in the PHC string format.
+func parseArgon2id(stored string) (argon2Params, []byte, []byte, bool) {
+	var params argon2Params
+	fields := strings.Split(stored, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return params, nil, nil, false
+	}
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, false
+	}
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.threads)
+	if err != nil || params.iterations == 0 || params.threads == 0 {
+		return params, nil, nil, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, false
+	}
+	return params, salt, key, true
+}
+
+// verifyArgon2id checks a password against an argon2id hash in the PHC
+// string format, using the parameters embedded in the hash. A malformed hash
+// never matches.
+func verifyArgon2id(stored, provided string) bool {
+	params, salt, key, ok := parseArgon2id(stored)
+	if !ok {
+		return false
+	}
+	providedKey := argon2.IDKey([]byte(provided), salt, params.iterations, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, providedKey) == 1
+}
+
+// redact hides a credential in logs, telling only whether it was given.
+// Anything which may hold a password must go through it before logging.
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
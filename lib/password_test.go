@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"bytes"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := HashPassword("secret", "bcrypt", bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("HashPassword(bcrypt) error = %v", err)
+	}
+	argon2Hash, err := HashPassword("secret", "argon2id", 0)
+	if err != nil {
+		t.Fatalf("HashPassword(argon2id) error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		stored   string
+		provided string
+		want     bool
+	}{
+		{"plaintext match", "secret", "secret", true},
+		{"plaintext mismatch", "secret", "secreT", false},
+		{"plaintext prefix", "secret", "secre", false},
+		{"bcrypt match", bcryptHash, "secret", true},
+		{"bcrypt mismatch", bcryptHash, "wrong", false},
+		{"argon2id match", argon2Hash, "secret", true},
+		{"argon2id mismatch", argon2Hash, "wrong", false},
+		{"malformed argon2id", "$argon2id$v=19$m=1,t=0,p=1$AAAA$AAAA", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyPassword(tt.stored, tt.provided); got != tt.want {
+				t.Errorf("verifyPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDummyHashMatchesScheme(t *testing.T) {
+	bcryptHash, err := HashPassword("secret", "bcrypt", bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatalf("HashPassword(bcrypt) error = %v", err)
+	}
+	argon2Hash, err := HashPassword("secret", "argon2id", 0)
+	if err != nil {
+		t.Fatalf("HashPassword(argon2id) error = %v", err)
+	}
+	for _, stored := range []string{bcryptHash, argon2Hash} {
+		dummy := dummyHash(stored)
+		if hashScheme(dummy) != hashScheme(stored) {
+			t.Errorf("dummyHash(%q) has scheme %q, want %q", stored, hashScheme(dummy), hashScheme(stored))
+		}
+		if verifyPassword(dummy, "secret") {
+			t.Errorf("dummyHash(%q) matches the password", stored)
+		}
+	}
+	if dummy := dummyHash("secret"); dummy != dummyPassword {
+		t.Errorf("dummyHash(plaintext) = %q, want %q", dummy, dummyPassword)
+	}
+	if scheme := hashScheme(mapDummyHash(map[string][]string{"alice": {bcryptHash}, "bob": {bcryptHash}, "carol": {"secret"}})); scheme != hashScheme(bcryptHash) {
+		t.Errorf("mapDummyHash() scheme = %q, want %q", scheme, hashScheme(bcryptHash))
+	}
+}
+
+func TestBackendDummy(t *testing.T) {
+	var d backendDummy
+	if scheme := hashScheme(d.get()); scheme != hashScheme(defaultDummyHash()) || scheme == "" {
+		t.Errorf("get() scheme before any password = %q, want bcrypt", scheme)
+	}
+	d.seen("secret")
+	if dummy := d.get(); dummy != dummyPassword {
+		t.Errorf("get() after a plaintext password = %q, want %q", dummy, dummyPassword)
+	}
+}
+
+// TestMapVerifyUnknownUserTiming checks that an unknown user is checked
+// against a hash as costly as the one of a known user, rather than answered
+// right away.
+func TestMapVerifyUnknownUserTiming(t *testing.T) {
+	hash, err := HashPassword("secret", "bcrypt", bcrypt.MinCost+2)
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	m := &Map{AuthData: []byte("alice=" + string(hash) + "\n")}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	measure := func(user string) time.Duration {
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			ok, err := m.Verify(user, "wrong")
+			if ok || err != nil {
+				t.Fatalf("Verify(%s) = %v, %v, want false", user, ok, err)
+			}
+		}
+		return time.Since(start)
+	}
+	measure("nobody")
+	wrongPassword := measure("alice")
+	unknownUser := measure("nobody")
+	if unknownUser < wrongPassword/4 {
+		t.Errorf("unknown user took %v, wrong password %v", unknownUser, wrongPassword)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	if got := redact(""); got != "" {
+		t.Errorf("redact(\"\") = %q, want empty", got)
+	}
+	if got := redact("secret"); strings.Contains(got, "secret") {
+		t.Errorf("redact(secret) = %q, want the password hidden", got)
+	}
+}
+
+func TestLoginNeverLogsPassword(t *testing.T) {
+	const password = "hunter2-s3cret"
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s := newTestServer(t, Config{AuthData: "alice=" + password, Logger: logger, AccessLog: true})
+	for _, content := range []string{
+		`{"user":"alice","metas":{"password":"` + password + `"}}`,
+		`{"user":"alice","metas":{"password":"` + password + `x"}}`,
+		`{"user":"mallory","metas":{"password":"` + password + `"}}`,
+		`{"user":"alice","metas":{"password":"` + password + `"},"unknown":` + "}",
+	} {
+		postPlugin(t, s, plugin.OpLogin, content)
+	}
+	if logs.Len() == 0 {
+		t.Fatal("nothing logged at debug level")
+	}
+	if strings.Contains(logs.String(), password) {
+		t.Errorf("password found in the logs:\n%s", logs.String())
+	}
+}
+
+func TestVerifyArgon2idKnownVector(t *testing.T) {
+	// from the argon2 reference implementation:
+	// echo -n password | argon2 somesalt -id -t 2 -m 16 -p 1 -l 32 -e
+	const stored = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	tests := []struct {
+		name     string
+		stored   string
+		provided string
+		want     bool
+	}{
+		{"match", stored, "password", true},
+		{"wrong password", stored, "Password", false},
+		{"other parameters", strings.Replace(stored, "p=1", "p=2", 1), "password", false},
+		{"other version", strings.Replace(stored, "v=19", "v=16", 1), "password", false},
+		{"truncated hash", stored[:len(stored)-4], "password", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyPassword(tt.stored, tt.provided); got != tt.want {
+				t.Errorf("verifyPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,521 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy holds the optional per-user restrictions. Inline policies are
+// attached to an auth file entry, e.g. `alice=secret;ports=8080,9000-9100`,
+// `alice=secret;types=tcp,http` or
+// `alice=secret;allow=10.0.0.0/8,2001:db8::/32;bandwidth=1MB`, and
+// `alice=secret;disabled=true` keeps a user which can not log in, and
+// `alice=secret;totp=JBSWY3DPEHPK3PXP` requires a one-time password in the
+// `otp` meta on login as a second factor.
+// The optional policy file is a YAML mapping keyed by the same user names:
+//
+//	alice:
+//	  ports: [8080, "9000-9100"]
+//	  types: [tcp, http]
+//	  domains: [alice, "*.alice.example.com"]
+//	  allow_cidrs: [10.0.0.0/8]
+//	  max_proxies: 5
+//	  expires: 2030-01-01T00:00:00Z
+//	  bandwidth: 1MB
+//	  disabled: false
+//	  totp: JBSWY3DPEHPK3PXP
+//
+// It only adds restrictions and never grants access to users missing from
+// the auth file. Fields set in the policy file override the inline ones, and
+// the whole file is rejected at load time if any field is invalid.
+type Policy struct {
+	Ports portRanges
+	// Types are the proxy types the user may create, any when empty.
+	Types      []string
+	Domains    []string
+	MaxProxies int
+	Expires    time.Time
+	// Allow limits the client addresses the user may log in from.
+	Allow ipNets
+	// Bandwidth is the limit, e.g. `1MB` or `512KB`, set on the proxies of
+	// the user by rewriting the NewProxy content. It needs frps 0.48.0 or
+	// newer, which limits bandwidth on the server: older versions, such as
+	// the v0.44.0 this module builds against, drop the rewritten fields.
+	Bandwidth string
+	Disabled  bool
+	// TOTP is the decoded TOTP secret, nil if the user has none.
+	TOTP []byte
+}
+
+// now is the clock used for policy checks, replaceable in tests.
+var now = time.Now
+
+// policyFileEntry is a user in the policy file. Ports, Types and AllowCIDRs take
+// a list or a comma separated string, as inline policies do.
+type policyFileEntry struct {
+	Ports      authEntries `yaml:"ports"`
+	Types      authEntries `yaml:"types"`
+	Domains    []string    `yaml:"domains"`
+	AllowCIDRs authEntries `yaml:"allow_cidrs"`
+	MaxProxies int         `yaml:"max_proxies"`
+	Expires    string      `yaml:"expires"`
+	Bandwidth  string      `yaml:"bandwidth"`
+	Disabled   bool        `yaml:"disabled"`
+	TOTP       string      `yaml:"totp"`
+}
+
+func readPolicyFile(filename string) (map[string]*Policy, error) {
+	PolicyDataBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]policyFileEntry
+	decoder := yaml.NewDecoder(bytes.NewReader(PolicyDataBytes))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&raw)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse policy file error: %v", err)
+	}
+	PolicyMap := make(map[string]*Policy)
+	for user, entry := range raw {
+		user = strings.TrimSpace(user)
+		policy, err := entry.policy()
+		if err != nil {
+			return nil, fmt.Errorf("policy file: user `%s`: %v", user, err)
+		}
+		PolicyMap[user] = policy
+	}
+	return PolicyMap, nil
+}
+
+func (e *policyFileEntry) policy() (*Policy, error) {
+	policy := &Policy{
+		Domains:    e.Domains,
+		MaxProxies: e.MaxProxies,
+		Disabled:   e.Disabled,
+	}
+	var err error
+	policy.Ports, err = parsePortRanges(strings.Join(e.Ports, ","))
+	if err != nil {
+		return nil, err
+	}
+	policy.Types, err = parseProxyTypes(strings.Join(e.Types, ","))
+	if err != nil {
+		return nil, err
+	}
+	policy.Allow, err = parseIPNets(strings.Join(e.AllowCIDRs, ","))
+	if err != nil {
+		return nil, err
+	}
+	if e.MaxProxies < 0 {
+		return nil, fmt.Errorf("invalid max_proxies `%d`", e.MaxProxies)
+	}
+	if e.Expires != "" {
+		policy.Expires, err = time.Parse(time.RFC3339, e.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires `%s`: %v", e.Expires, err)
+		}
+	}
+	if e.Bandwidth != "" {
+		policy.Bandwidth, err = parseBandwidth(e.Bandwidth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.TOTP != "" {
+		policy.TOTP, err = parseTOTPSecret(e.TOTP)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func mergePolicies(dst map[string]*Policy, src map[string]*Policy) {
+	for user, policy := range src {
+		current, ok := dst[user]
+		if !ok {
+			dst[user] = policy
+			continue
+		}
+		if len(policy.Ports) > 0 {
+			current.Ports = policy.Ports
+		}
+		if len(policy.Types) > 0 {
+			current.Types = policy.Types
+		}
+		if len(policy.Domains) > 0 {
+			current.Domains = policy.Domains
+		}
+		if policy.MaxProxies > 0 {
+			current.MaxProxies = policy.MaxProxies
+		}
+		if !policy.Expires.IsZero() {
+			current.Expires = policy.Expires
+		}
+		if len(policy.Allow) > 0 {
+			current.Allow = policy.Allow
+		}
+		if policy.Bandwidth != "" {
+			current.Bandwidth = policy.Bandwidth
+		}
+		if policy.Disabled {
+			current.Disabled = true
+		}
+		if policy.TOTP != nil {
+			current.TOTP = policy.TOTP
+		}
+	}
+}
+
+func matchDomain(pattern, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	domain = strings.ToLower(domain)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return pattern == domain
+}
+
+func (p *Policy) allowDomain(domain string) bool {
+	for _, pattern := range p.Domains {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+type portRange struct {
+	Low  int
+	High int
+}
+
+type portRanges []portRange
+
+func (p portRanges) Contains(port int) bool {
+	for _, r := range p {
+		if port >= r.Low && port <= r.High {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRanges(s string) (portRanges, error) {
+	var ranges portRanges
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port `%s`", item)
+		}
+		high := low
+		if len(bounds) == 2 {
+			high, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid port `%s`", item)
+			}
+		}
+		if low < 0 || high > 65535 || low > high {
+			return nil, fmt.Errorf("invalid port range `%s`", item)
+		}
+		ranges = append(ranges, portRange{Low: low, High: high})
+	}
+	return ranges, nil
+}
+
+type ipNets []netip.Prefix
+
+func (n ipNets) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range n {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPNets parses a comma separated list of CIDRs, a bare address
+// standing for itself.
+func parseIPNets(s string) (ipNets, error) {
+	var nets ipNets
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr `%s`", item)
+			}
+			addr = addr.Unmap()
+			nets = append(nets, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr `%s`", item)
+		}
+		nets = append(nets, prefix.Masked())
+	}
+	return nets, nil
+}
+
+// proxyTypes are the proxy types of frp.
+var proxyTypes = map[string]bool{
+	"tcp":    true,
+	"udp":    true,
+	"http":   true,
+	"https":  true,
+	"stcp":   true,
+	"xtcp":   true,
+	"sudp":   true,
+	"tcpmux": true,
+}
+
+// parseProxyTypes parses a comma separated list of proxy types.
+func parseProxyTypes(s string) ([]string, error) {
+	var types []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if !proxyTypes[item] {
+			return nil, fmt.Errorf("invalid proxy type `%s`", item)
+		}
+		types = append(types, item)
+	}
+	return types, nil
+}
+
+// parseBandwidth checks a bandwidth limit in the format of frp, a positive
+// number of MB or KB.
+func parseBandwidth(s string) (string, error) {
+	value := strings.ToUpper(s)
+	if !strings.HasSuffix(value, "MB") && !strings.HasSuffix(value, "KB") {
+		return "", fmt.Errorf("invalid bandwidth `%s`", s)
+	}
+	n, err := strconv.ParseInt(value[:len(value)-2], 10, 64)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid bandwidth `%s`", s)
+	}
+	return value, nil
+}
+
+// parseAddr parses a client address, with or without a port.
+func parseAddr(s string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	return addr.Unmap(), err
+}
+
+// policyKeys are the names of the inline policies.
+var policyKeys = map[string]bool{
+	"ports":       true,
+	"types":       true,
+	"expires":     true,
+	"max_proxies": true,
+	"allow":       true,
+	"bandwidth":   true,
+	"disabled":    true,
+	"totp":        true,
+}
+
+// parseAuthEntry splits an auth file value into the password and its policy.
+// The policies are the trailing `;key=value` fields with a known key, so a
+// password may contain `;`: `pa;ss` is a password, and so is `pa;ss;x=1`.
+func parseAuthEntry(value string) (string, *Policy, error) {
+	fields := strings.Split(value, ";")
+	n := len(fields)
+	for i := len(fields) - 1; i > 0; i-- {
+		field := strings.TrimSpace(fields[i])
+		if field == "" {
+			continue
+		}
+		if !policyKeys[strings.TrimSpace(strings.SplitN(field, "=", 2)[0])] || !strings.Contains(field, "=") {
+			break
+		}
+		n = i
+	}
+	password := strings.TrimSpace(strings.Join(fields[:n], ";"))
+	if n == len(fields) {
+		return password, nil, nil
+	}
+	policy := &Policy{}
+	for _, field := range fields[n:] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kvs := strings.SplitN(field, "=", 2)
+		key, val := strings.TrimSpace(kvs[0]), strings.TrimSpace(kvs[1])
+		switch key {
+		case "ports":
+			ports, err := parsePortRanges(val)
+			if err != nil {
+				return "", nil, err
+			}
+			policy.Ports = ports
+		case "types":
+			types, err := parseProxyTypes(val)
+			if err != nil {
+				return "", nil, err
+			}
+			policy.Types = types
+		case "expires":
+			expires, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid expires `%s`: %v", val, err)
+			}
+			policy.Expires = expires
+		case "max_proxies":
+			maxProxies, err := strconv.Atoi(val)
+			if err != nil || maxProxies < 0 {
+				return "", nil, fmt.Errorf("invalid max_proxies `%s`", val)
+			}
+			policy.MaxProxies = maxProxies
+		case "allow":
+			allow, err := parseIPNets(val)
+			if err != nil {
+				return "", nil, err
+			}
+			policy.Allow = allow
+		case "bandwidth":
+			bandwidth, err := parseBandwidth(val)
+			if err != nil {
+				return "", nil, err
+			}
+			policy.Bandwidth = bandwidth
+		case "disabled":
+			disabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid disabled `%s`", val)
+			}
+			policy.Disabled = disabled
+		case "totp":
+			secret, err := parseTOTPSecret(val)
+			if err != nil {
+				return "", nil, err
+			}
+			policy.TOTP = secret
+		}
+	}
+	return password, policy, nil
+}
+
+func splitAuthMap(AuthMap map[string][]string) (map[string][]string, map[string]*Policy, error) {
+	PasswordMap := make(map[string][]string)
+	PolicyMap := make(map[string]*Policy)
+	for user, entries := range AuthMap {
+		for _, entry := range entries {
+			password, policy, err := parseAuthEntry(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("user `%s`: %v", user, err)
+			}
+			if password == "" {
+				continue
+			}
+			PasswordMap[user] = append(PasswordMap[user], password)
+			// the policy is per user, the last entry carrying one wins
+			if policy != nil {
+				PolicyMap[user] = policy
+			}
+		}
+	}
+	return PasswordMap, PolicyMap, nil
+}
+
+// checkNewProxy returns a reject reason, or an empty string if the proxy is
+// allowed. A nil policy allows everything.
+func (p *Policy) checkNewProxy(content *plugin.NewProxyContent) string {
+	if p == nil {
+		return ""
+	}
+	if len(p.Types) > 0 && !p.allowType(content.ProxyType) {
+		return fmt.Sprintf("proxy type `%s` is not allowed for user `%s`, allowed: %s", content.ProxyType, content.User.User, strings.Join(p.Types, ","))
+	}
+	switch content.ProxyType {
+	case "tcp", "udp":
+		if len(p.Ports) > 0 && !p.Ports.Contains(content.RemotePort) {
+			return fmt.Sprintf("remote port %d is not allowed for user `%s`", content.RemotePort, content.User.User)
+		}
+	}
+	if len(p.Domains) > 0 {
+		if content.SubDomain != "" && !p.allowDomain(content.SubDomain) {
+			return fmt.Sprintf("subdomain `%s` is not allowed for user `%s`", content.SubDomain, content.User.User)
+		}
+		for _, domain := range content.CustomDomains {
+			if !p.allowDomain(domain) {
+				return fmt.Sprintf("custom domain `%s` is not allowed for user `%s`", domain, content.User.User)
+			}
+		}
+	}
+	return ""
+}
+
+func (p *Policy) allowType(proxyType string) bool {
+	for _, allowed := range p.Types {
+		if allowed == proxyType {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether the credential has expired at t. A nil policy or
+// a zero expiry never expires.
+func (p *Policy) expired(t time.Time) bool {
+	return p != nil && !p.Expires.IsZero() && !t.Before(p.Expires)
+}
+
+// disabled reports whether the user is disabled. A nil policy is enabled.
+func (p *Policy) disabled() bool {
+	return p != nil && p.Disabled
+}
+
+// allowAddr reports whether the user may log in from the client address.
+// A nil policy or an empty allowlist allows any address.
+func (p *Policy) allowAddr(addr string) bool {
+	if p == nil || len(p.Allow) == 0 {
+		return true
+	}
+	ip, err := parseAddr(addr)
+	return err == nil && p.Allow.Contains(ip)
+}
+
+// checkOTP reports whether code is the current one-time password of the
+// user. A nil policy or one without a TOTP secret needs none.
+func (p *Policy) checkOTP(code string, t time.Time) bool {
+	if p == nil || p.TOTP == nil {
+		return true
+	}
+	return verifyTOTP(p.TOTP, code, t)
+}
+
+// maxProxies returns the proxy limit of the user, falling back to the
+// global default when the policy does not set one.
+func (p *Policy) maxProxies(defaultLimit int) int {
+	if p != nil && p.MaxProxies > 0 {
+		return p.MaxProxies
+	}
+	return defaultLimit
+}
@@ -0,0 +1,433 @@
+package lib
+
+import (
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseAuthEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		password string
+		policy   bool
+		wantErr  bool
+	}{
+		{name: "plain password", value: "secret", password: "secret"},
+		{name: "password with semicolon", value: "pa;ss", password: "pa;ss"},
+		{name: "password with unknown suffix", value: "pa;ss;x=1", password: "pa;ss;x=1"},
+		{name: "password with trailing semicolon", value: "secret;", password: "secret;"},
+		{name: "policy", value: "secret;ports=8080", password: "secret", policy: true},
+		{name: "password with semicolon and policy", value: "pa;ss;ports=8080", password: "pa;ss", policy: true},
+		{name: "several policies", value: "secret; ports=8080 ;max_proxies=2", password: "secret", policy: true},
+		{name: "policy before unknown suffix", value: "secret;ports=8080;ss", password: "secret;ports=8080;ss"},
+		{name: "invalid policy value", value: "secret;ports=abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password, policy, err := parseAuthEntry(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAuthEntry(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if password != tt.password {
+				t.Errorf("parseAuthEntry(%q) password = %q, want %q", tt.value, password, tt.password)
+			}
+			if (policy != nil) != tt.policy {
+				t.Errorf("parseAuthEntry(%q) policy = %v, want policy %v", tt.value, policy, tt.policy)
+			}
+		})
+	}
+}
+
+func TestParseAuthDataPasswordWithSemicolon(t *testing.T) {
+	m := &Map{AuthData: []byte("alice=pa;ss\n")}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	ok, err := m.Verify("alice", "pa;ss")
+	if err != nil || !ok {
+		t.Errorf("Verify(alice, pa;ss) = %v, %v, want true", ok, err)
+	}
+}
+
+func TestCheckNewProxyPorts(t *testing.T) {
+	_, policy, err := parseAuthEntry("secret;ports=8080,9000-9100")
+	if err != nil {
+		t.Fatalf("parseAuthEntry() error = %v", err)
+	}
+	tests := []struct {
+		port    int
+		allowed bool
+	}{
+		{8079, false},
+		{8080, true},
+		{8081, false},
+		{8999, false},
+		{9000, true},
+		{9050, true},
+		{9100, true},
+		{9101, false},
+	}
+	for _, tt := range tests {
+		for _, proxyType := range []string{"tcp", "udp"} {
+			content := &plugin.NewProxyContent{}
+			content.User.User = "alice"
+			content.ProxyType = proxyType
+			content.RemotePort = tt.port
+			if reason := policy.checkNewProxy(content); (reason == "") != tt.allowed {
+				t.Errorf("%s port %d: reason %q, want allowed %v", proxyType, tt.port, reason, tt.allowed)
+			}
+		}
+	}
+	var none *Policy
+	content := &plugin.NewProxyContent{}
+	content.ProxyType = "tcp"
+	content.RemotePort = 1
+	if reason := none.checkNewProxy(content); reason != "" {
+		t.Errorf("nil policy: reason %q, want allowed", reason)
+	}
+}
+
+func TestParsePortRangesInvalid(t *testing.T) {
+	for _, s := range []string{"abc", "-1", "65536", "9100-9000", "1-"} {
+		if _, err := parsePortRanges(s); err == nil {
+			t.Errorf("parsePortRanges(%q) error = nil, want error", s)
+		}
+	}
+}
+
+func TestCheckNewProxyTypes(t *testing.T) {
+	tests := []struct {
+		name      string
+		entry     string
+		proxyType string
+		allowed   bool
+	}{
+		{name: "allowed type", entry: "secret;types=tcp,http", proxyType: "http", allowed: true},
+		{name: "disallowed type", entry: "secret;types=tcp,http", proxyType: "udp"},
+		{name: "case insensitive list", entry: "secret;types=TCP", proxyType: "tcp", allowed: true},
+		{name: "no restriction", entry: "secret;max_proxies=1", proxyType: "xtcp", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, policy, err := parseAuthEntry(tt.entry)
+			if err != nil {
+				t.Fatalf("parseAuthEntry(%q) error = %v", tt.entry, err)
+			}
+			content := &plugin.NewProxyContent{}
+			content.User.User = "alice"
+			content.ProxyType = tt.proxyType
+			if reason := policy.checkNewProxy(content); (reason == "") != tt.allowed {
+				t.Errorf("checkNewProxy(%s) reason %q, want allowed %v", tt.proxyType, reason, tt.allowed)
+			}
+		})
+	}
+	if _, err := parseProxyTypes("tcp,ftp"); err == nil {
+		t.Error("parseProxyTypes(tcp,ftp) error = nil, want error")
+	}
+}
+
+func TestCheckNewProxyDomains(t *testing.T) {
+	policy := &Policy{Domains: []string{"alice", "*.alice.example.com"}}
+	tests := []struct {
+		name          string
+		subDomain     string
+		customDomains []string
+		allowed       bool
+	}{
+		{name: "subdomain", subDomain: "alice", allowed: true},
+		{name: "subdomain case", subDomain: "ALICE", allowed: true},
+		{name: "other subdomain", subDomain: "bob"},
+		{name: "wildcard custom domain", customDomains: []string{"www.alice.example.com"}, allowed: true},
+		{name: "wildcard excludes apex", customDomains: []string{"alice.example.com"}},
+		{name: "one custom domain not allowed", customDomains: []string{"www.alice.example.com", "bob.example.com"}},
+		{name: "suffix is not a subdomain", customDomains: []string{"evilalice.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := &plugin.NewProxyContent{}
+			content.User.User = "alice"
+			content.ProxyType = "http"
+			content.SubDomain = tt.subDomain
+			content.CustomDomains = tt.customDomains
+			if reason := policy.checkNewProxy(content); (reason == "") != tt.allowed {
+				t.Errorf("checkNewProxy() reason %q, want allowed %v", reason, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestPolicyExpired(t *testing.T) {
+	at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		entry   string
+		expired bool
+	}{
+		{name: "expired", entry: "secret;expires=2024-06-01T11:59:59Z", expired: true},
+		{name: "expires now", entry: "secret;expires=2024-06-01T12:00:00Z", expired: true},
+		{name: "not yet expired", entry: "secret;expires=2024-06-01T12:00:01Z"},
+		{name: "other zone", entry: "secret;expires=2024-06-01T13:30:00+02:00", expired: true},
+		{name: "missing expiry", entry: "secret"},
+		{name: "policy without expiry", entry: "secret;max_proxies=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, policy, err := parseAuthEntry(tt.entry)
+			if err != nil {
+				t.Fatalf("parseAuthEntry(%q) error = %v", tt.entry, err)
+			}
+			if expired := policy.expired(at); expired != tt.expired {
+				t.Errorf("expired() = %v, want %v", expired, tt.expired)
+			}
+		})
+	}
+	if _, _, err := parseAuthEntry("secret;expires=2024-06-01"); err == nil {
+		t.Error("parseAuthEntry() with a date only expiry error = nil, want error")
+	}
+}
+
+func TestLoginExpired(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	s := newTestServer(t, Config{AuthData: "alice=x;expires=2024-01-01T00:00:00Z\nbob=y;expires=2025-01-01T00:00:00Z\n"})
+	resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`))
+	if !resp.Reject || resp.RejectReason != "credential expired" {
+		t.Errorf("expired login = %v %q, want rejected with credential expired", resp.Reject, resp.RejectReason)
+	}
+	resp = decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"wrong"}}`))
+	if resp.RejectReason == "credential expired" {
+		t.Error("expired login with a wrong password reveals the expiry")
+	}
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"bob","metas":{"password":"y"}}`)); resp.Reject {
+		t.Errorf("login before the expiry rejected: %s", resp.RejectReason)
+	}
+}
+
+func TestPolicyAllowAddr(t *testing.T) {
+	_, policy, err := parseAuthEntry("secret;allow=10.0.0.0/8,192.168.1.5/32,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("parseAuthEntry() error = %v", err)
+	}
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"10.1.2.3:7000", true},
+		{"11.0.0.1:7000", false},
+		{"192.168.1.5:7000", true},
+		{"192.168.1.6:7000", false},
+		{"::ffff:10.1.2.3", true},
+		{"[2001:db8::1]:7000", true},
+		{"2001:db9::1", false},
+		{"", false},
+		{"not an address", false},
+	}
+	for _, tt := range tests {
+		if allowed := policy.allowAddr(tt.addr); allowed != tt.allowed {
+			t.Errorf("allowAddr(%q) = %v, want %v", tt.addr, allowed, tt.allowed)
+		}
+	}
+	var none *Policy
+	if !none.allowAddr("203.0.113.1") {
+		t.Error("nil policy: allowAddr() = false, want true")
+	}
+}
+
+func TestLoginClientAddr(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x;allow=10.0.0.0/8\nbob=y\n"})
+	tests := []struct {
+		name   string
+		user   string
+		addr   string
+		reject bool
+	}{
+		{name: "in range", user: "alice", addr: "10.0.0.1:5000"},
+		{name: "out of range", user: "alice", addr: "172.16.0.1:5000", reject: true},
+		{name: "plugin request address used when missing", user: "alice", reject: true},
+		{name: "unrestricted user", user: "bob", addr: "172.16.0.1:5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password := map[string]string{"alice": "x", "bob": "y"}[tt.user]
+			content := `{"user":"` + tt.user + `","client_address":"` + tt.addr + `","metas":{"password":"` + password + `"}}`
+			if resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, content)); resp.Reject != tt.reject {
+				t.Errorf("reject = %v (%s), want %v", resp.Reject, resp.RejectReason, tt.reject)
+			}
+		})
+	}
+	for _, value := range []string{"10.0.0.0/33", "10.0.0.0.1", "host"} {
+		if _, err := parseIPNets(value); err == nil {
+			t.Errorf("parseIPNets(%q) error = nil, want error", value)
+		}
+	}
+}
+
+func TestLoginDisabled(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x;disabled=true\nbob=y;disabled=false\n"})
+	resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`))
+	if !resp.Reject || resp.RejectReason != "account disabled" {
+		t.Errorf("disabled login = %v %q, want rejected with account disabled", resp.Reject, resp.RejectReason)
+	}
+	resp = decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"wrong"}}`))
+	if resp.RejectReason == "account disabled" {
+		t.Error("disabled login with a wrong password reveals the account state")
+	}
+	if resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"bob","metas":{"password":"y"}}`)); resp.Reject {
+		t.Errorf("login of an enabled user rejected: %s", resp.RejectReason)
+	}
+	if _, _, err := parseAuthEntry("x;disabled=maybe"); err == nil {
+		t.Error("parseAuthEntry(x;disabled=maybe) error = nil, want error")
+	}
+}
+
+func TestMapReenableUser(t *testing.T) {
+	m := &Map{AuthData: []byte("alice=x;disabled=true\n")}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if !m.Policy("alice").disabled() {
+		t.Fatal("alice enabled, want disabled")
+	}
+	m.AuthData = []byte("alice=x\n")
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if m.Policy("alice").disabled() {
+		t.Error("alice still disabled after the marker was removed")
+	}
+}
+
+func TestWriteAuthFileKeepsDisabled(t *testing.T) {
+	for _, name := range []string{"tokens", "tokens.json", "tokens.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), name)
+			if err := writeAuthFile(filename, map[string][]string{"alice": {"x;disabled=true"}}); err != nil {
+				t.Fatalf("writeAuthFile() error = %v", err)
+			}
+			AuthMap, err := readAuthFile(filename, "")
+			if err != nil {
+				t.Fatalf("readAuthFile() error = %v", err)
+			}
+			PasswordMap, PolicyMap, err := splitAuthMap(AuthMap)
+			if err != nil {
+				t.Fatalf("splitAuthMap() error = %v", err)
+			}
+			if !reflect.DeepEqual(PasswordMap["alice"], []string{"x"}) {
+				t.Errorf("passwords = %v, want [x]", PasswordMap["alice"])
+			}
+			if !PolicyMap["alice"].disabled() {
+				t.Error("alice enabled after the round trip, want disabled")
+			}
+		})
+	}
+}
+
+const testPolicyFile = `alice:
+  ports: [8080, "9000-9100"]
+  types: tcp, http
+  domains: [alice, "*.alice.example.com"]
+  allow_cidrs: [10.0.0.0/8]
+  max_proxies: 5
+  expires: 2030-01-01T00:00:00Z
+  bandwidth: 1mb
+  totp: JBSWY3DPEHPK3PXP
+bob:
+  disabled: true
+`
+
+func TestReadPolicyFile(t *testing.T) {
+	PolicyMap, err := readPolicyFile(writeTestFile(t, "policy.yaml", testPolicyFile))
+	if err != nil {
+		t.Fatalf("readPolicyFile() error = %v", err)
+	}
+	alice := PolicyMap["alice"]
+	if alice == nil {
+		t.Fatal("no policy for alice")
+	}
+	if !alice.Ports.Contains(8080) || !alice.Ports.Contains(9050) || alice.Ports.Contains(8081) {
+		t.Errorf("Ports = %v, want 8080,9000-9100", alice.Ports)
+	}
+	if !reflect.DeepEqual(alice.Types, []string{"tcp", "http"}) {
+		t.Errorf("Types = %v, want [tcp http]", alice.Types)
+	}
+	if !alice.allowDomain("alice") || !alice.allowDomain("www.alice.example.com") || alice.allowDomain("bob") {
+		t.Errorf("Domains = %v, want alice and *.alice.example.com", alice.Domains)
+	}
+	if !alice.allowAddr("10.1.1.1") || alice.allowAddr("11.1.1.1") {
+		t.Errorf("Allow = %v, want 10.0.0.0/8", alice.Allow)
+	}
+	if alice.maxProxies(0) != 5 {
+		t.Errorf("MaxProxies = %d, want 5", alice.MaxProxies)
+	}
+	if want := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC); !alice.Expires.Equal(want) {
+		t.Errorf("Expires = %v, want %v", alice.Expires, want)
+	}
+	if alice.Bandwidth != "1MB" {
+		t.Errorf("Bandwidth = %q, want 1MB", alice.Bandwidth)
+	}
+	if alice.TOTP == nil || alice.disabled() {
+		t.Errorf("TOTP = %v, Disabled = %v, want a secret and enabled", alice.TOTP, alice.Disabled)
+	}
+	if !PolicyMap["bob"].disabled() {
+		t.Error("bob enabled, want disabled")
+	}
+}
+
+func TestReadPolicyFileInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "unknown field", data: "alice:\n  port: [8080]\n"},
+		{name: "invalid ports", data: "alice:\n  ports: [abc]\n"},
+		{name: "invalid type", data: "alice:\n  types: [ftp]\n"},
+		{name: "invalid cidr", data: "alice:\n  allow_cidrs: [10.0.0.0/33]\n"},
+		{name: "negative max_proxies", data: "alice:\n  max_proxies: -1\n"},
+		{name: "invalid expires", data: "alice:\n  expires: tomorrow\n"},
+		{name: "invalid bandwidth", data: "alice:\n  bandwidth: 1GB\n"},
+		{name: "invalid totp", data: "alice:\n  totp: \"!\"\n"},
+		{name: "not a mapping", data: "- alice\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readPolicyFile(writeTestFile(t, "policy.yaml", tt.data)); err == nil {
+				t.Error("readPolicyFile() error = nil, want error")
+			}
+		})
+	}
+	if PolicyMap, err := readPolicyFile(writeTestFile(t, "policy.yaml", "")); err != nil || len(PolicyMap) != 0 {
+		t.Errorf("readPolicyFile(empty) = %v, %v, want no policies", PolicyMap, err)
+	}
+}
+
+func TestMapPolicyFilePrecedence(t *testing.T) {
+	m := &Map{
+		AuthData:   []byte("alice=x;ports=22;max_proxies=1\ncarol=z\n"),
+		PolicyFile: writeTestFile(t, "policy.yaml", "alice:\n  ports: [8080]\nmallory:\n  max_proxies: 5\n"),
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	alice := m.Policy("alice")
+	if !alice.Ports.Contains(8080) || alice.Ports.Contains(22) {
+		t.Errorf("Ports = %v, want the policy file to override the inline ports", alice.Ports)
+	}
+	if alice.maxProxies(0) != 1 {
+		t.Errorf("MaxProxies = %d, want the inline 1 kept", alice.MaxProxies)
+	}
+	if m.Policy("carol") != nil {
+		t.Errorf("carol policy = %v, want none", m.Policy("carol"))
+	}
+	if ok, _ := m.Verify("mallory", ""); ok {
+		t.Error("user only in the policy file verified, want rejected")
+	}
+}
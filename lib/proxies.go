@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"sync"
+)
+
+// proxyTracker counts the active proxies of each user from NewProxy and
+// CloseProxy operations. Proxies are keyed by name, so a proxy registered
+// again after a reconnect is not counted twice.
+type proxyTracker struct {
+	proxies map[string]map[string]struct{}
+	lock    sync.Mutex
+}
+
+func newProxyTracker() *proxyTracker {
+	return &proxyTracker{
+		proxies: make(map[string]map[string]struct{}),
+	}
+}
+
+// Acquire registers a proxy for a user unless it would exceed limit. A limit
+// of zero or less is unlimited.
+func (t *proxyTracker) Acquire(user, name string, limit int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	names, ok := t.proxies[user]
+	if !ok {
+		names = make(map[string]struct{})
+		t.proxies[user] = names
+	}
+	if _, ok := names[name]; ok {
+		return true
+	}
+	if limit > 0 && len(names) >= limit {
+		return false
+	}
+	names[name] = struct{}{}
+	return true
+}
+
+func (t *proxyTracker) Release(user, name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	names, ok := t.proxies[user]
+	if !ok {
+		return
+	}
+	delete(names, name)
+	if len(names) == 0 {
+		delete(t.proxies, user)
+	}
+}
+
+// Counts returns the number of active proxies of each user with any.
+func (t *proxyTracker) Counts() map[string]int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	counts := make(map[string]int, len(t.proxies))
+	for user, names := range t.proxies {
+		counts[user] = len(names)
+	}
+	return counts
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"container/list"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+const rateLimiterSize = 10000
+
+// rateLimiter keeps a token bucket per key, e.g. per client ip. Only the
+// most recently used rateLimiterSize keys are kept, so memory stays bounded.
+// A nil rateLimiter allows everything.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	items map[string]*list.Element
+	order *list.List
+	lock  sync.Mutex
+}
+
+type rateLimiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		limit: rate.Limit(limit),
+		burst: burst,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (l *rateLimiter) get(key string) *rate.Limiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if element, ok := l.items[key]; ok {
+		l.order.MoveToFront(element)
+		return element.Value.(*rateLimiterEntry).limiter
+	}
+	entry := &rateLimiterEntry{
+		key:     key,
+		limiter: rate.NewLimiter(l.limit, l.burst),
+	}
+	l.items[key] = l.order.PushFront(entry)
+	if l.order.Len() > rateLimiterSize {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*rateLimiterEntry).key)
+	}
+	return entry.limiter
+}
+
+// Delay takes a token for key and returns zero, or, when there is none
+// left, how long until there is one, leaving the bucket untouched.
+func (l *rateLimiter) Delay(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	r := l.get(key).Reserve()
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return delay
+	}
+	return 0
+}
+
+// limiterKey returns the ip of a client address, with or without a port,
+// so that every connection of a client shares its bucket.
+func limiterKey(addr string) string {
+	if ip, err := parseAddr(addr); err == nil {
+		return ip.String()
+	}
+	return addr
+}
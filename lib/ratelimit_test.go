@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterDelay(t *testing.T) {
+	l := newRateLimiter(0.001, 2)
+	for i := 0; i < 2; i++ {
+		if delay := l.Delay("a"); delay != 0 {
+			t.Fatalf("Delay(a) #%d = %v, want 0 within the burst", i, delay)
+		}
+	}
+	if delay := l.Delay("a"); delay <= 0 {
+		t.Errorf("Delay(a) = %v, want > 0 past the burst", delay)
+	}
+	if delay := l.Delay("b"); delay != 0 {
+		t.Errorf("Delay(b) = %v, want 0 for another key", delay)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(0, 1)
+	if l != nil {
+		t.Fatalf("newRateLimiter(0, 1) = %v, want nil", l)
+	}
+	for i := 0; i < 100; i++ {
+		if delay := l.Delay("a"); delay != 0 {
+			t.Fatalf("nil Delay() = %v, want 0", delay)
+		}
+	}
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	l := newRateLimiter(0.001, 1)
+	l.Delay("first")
+	for i := 0; i < rateLimiterSize; i++ {
+		l.Delay(fmt.Sprint(i))
+	}
+	if n := len(l.items); n != rateLimiterSize {
+		t.Errorf("len(items) = %d, want %d", n, rateLimiterSize)
+	}
+	if _, ok := l.items["first"]; ok {
+		t.Error("least recently used key kept, want evicted")
+	}
+	// an evicted key starts over with a full bucket
+	if delay := l.Delay("first"); delay != 0 {
+		t.Errorf("Delay(first) = %v, want 0 after eviction", delay)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", RateLimit: 0.001, RateBurst: 3})
+	limited := 0
+	for i := 0; i < 10; i++ {
+		w := postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"wrong"}}`)
+		switch w.Code {
+		case http.StatusOK:
+		case http.StatusTooManyRequests:
+			limited++
+		default:
+			t.Fatalf("status = %d, want 200 or 429", w.Code)
+		}
+	}
+	if limited != 7 {
+		t.Errorf("%d logins throttled, want 7", limited)
+	}
+}
+
+func TestLoginRateLimitPerClientAddress(t *testing.T) {
+	// every request comes from frps, the client addresses differ
+	s := newTestServer(t, Config{AuthData: "alice=x", RateLimit: 0.001, RateBurst: 2})
+	login := func(clientAddr string) int {
+		return postPlugin(t, s, plugin.OpLogin, `{"user":"alice","client_address":"`+clientAddr+`","metas":{"password":"wrong"}}`).Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := login(fmt.Sprintf("198.51.100.1:%d", 5000+i)); code != http.StatusOK {
+			t.Fatalf("login #%d from 198.51.100.1 status = %d, want 200", i, code)
+		}
+	}
+	if code := login("198.51.100.1:6000"); code != http.StatusTooManyRequests {
+		t.Errorf("login from 198.51.100.1 on another port status = %d, want 429", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := login("198.51.100.2:5000"); code != http.StatusOK {
+			t.Errorf("login #%d from 198.51.100.2 status = %d, want its own budget", i, code)
+		}
+	}
+}
+
+func TestLoginUserRateLimit(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x\nbob=y", RateLimit: 100, RateBurst: 100, UserRateLimit: 0.001, UserRateBurst: 2})
+	login := func(user, remoteAddr string) int {
+		body := `{"version":"` + plugin.APIVersion + `","op":"` + plugin.OpLogin + `","content":{"user":"` + user + `","metas":{"password":"wrong"}}}`
+		r := httptest.NewRequest(http.MethodPost, "/handler", strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+	limited := 0
+	for i := 0; i < 10; i++ {
+		if login("alice", fmt.Sprintf("203.0.113.%d:1234", i+1)) == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 8 {
+		t.Errorf("%d logins of alice from distinct ips throttled, want 8", limited)
+	}
+	if code := login("bob", "203.0.113.1:1234"); code != http.StatusOK {
+		t.Errorf("login of bob status = %d, want 200", code)
+	}
+}
+
+func TestLoginRateLimitRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{name: "default status", want: http.StatusTooManyRequests},
+		{name: "custom status", status: http.StatusServiceUnavailable, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// one attempt every 10s
+			s := newTestServer(t, Config{AuthData: "alice=x", RateLimit: 0.1, RateBurst: 1, RateLimitStatus: tt.status})
+			if w := postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`); w.Code != http.StatusOK {
+				t.Fatalf("first login status = %d, want 200", w.Code)
+			}
+			w := postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"x"}}`)
+			if w.Code != tt.want {
+				t.Fatalf("throttled login status = %d, want %d", w.Code, tt.want)
+			}
+			retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			if err != nil || retryAfter < 1 || retryAfter > 10 {
+				t.Errorf("Retry-After = %q, want 1 to 10 seconds", w.Header().Get("Retry-After"))
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode body error = %v", err)
+			}
+			if want := fmt.Sprintf("too many login attempts, retry after %ds", retryAfter); body["msg"] != want {
+				t.Errorf("msg = %q, want %q", body["msg"], want)
+			}
+		})
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		want  int
+	}{
+		{0, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{time.Second + time.Millisecond, 2},
+		{10 * time.Second, 10},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.delay); got != tt.want {
+			t.Errorf("retryAfterSeconds(%v) = %d, want %d", tt.delay, got, tt.want)
+		}
+	}
+}
@@ -2,188 +2,744 @@ package lib
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	plugin "github.com/fatedier/frp/pkg/plugin/server"
 	"github.com/fsnotify/fsnotify"
-	"io/ioutil"
-	"log"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 )
 
-type Config struct {
-	BindAddress string
-	AuthFile    string
-	Inotify     bool
-}
+const shutdownTimeout = 10 * time.Second
+
+// Default http server timeouts, used when the Config leaves them at zero.
+// Plugin requests are small and quick, so a client which can not send its
+// headers within 5s or its request within 10s is dropped.
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 10 * time.Second
+	defaultWriteTimeout      = 10 * time.Second
+	defaultIdleTimeout       = 60 * time.Second
+)
 
-type Map struct {
-	Data        map[string]string
-	RefreshChan chan struct{}
-	Lock        sync.RWMutex
+// Server is a frp server plugin checking the credentials of frp users.
+type Server struct {
+	cfg         Config
+	logger      *slog.Logger
+	store       AuthStore
+	authFiles   []string
+	authURLs    bool
+	refreshChan chan struct{}
+	proxies     *proxyTracker
+	limiter     *rateLimiter
+	userLimiter *rateLimiter
+	allowNets   ipNets
+	denyNets    ipNets
+	// trustedProxies may set the client address in X-Forwarded-For.
+	trustedProxies ipNets
+	// maintenance is set while logins are rejected for maintenance.
+	maintenance atomic.Bool
+	// ready is set once the credentials are loaded and cleared while
+	// reloading them fails.
+	ready atomic.Bool
+	// sem holds a slot per plugin request in flight, nil if unlimited.
+	sem     chan struct{}
+	metrics http.Handler
+	tracer  trace.Tracer
+	// tracerShutdown flushes the spans when the server stops.
+	tracerShutdown func(context.Context) error
+	server         *http.Server
+	admin          *http.Server
+	// listener and adminListener are bound by NewServer and served by Run.
+	listener      net.Listener
+	adminListener net.Listener
+
+	// lock guards the lifecycle fields below, shared by Run and Stop.
+	lock    sync.Mutex
+	stopped bool
+	cancel  context.CancelFunc
+	done    chan struct{}
 }
 
-func NewServer(cfg Config) {
-	logger := log.Logger{}
-	logger.SetFlags(log.LstdFlags | log.Lshortfile)
-	logger.SetOutput(os.Stdout)
-	logger.SetPrefix("")
-	_, _, err := net.SplitHostPort(cfg.BindAddress)
+// NewServer validates the config and loads the credentials. Call Run to
+// start serving.
+func NewServer(cfg Config) (_ *Server, err error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger, err = newLogger(cfg.LogFormat, cfg.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	BindAddress, err := normalizeBindAddress(cfg.BindAddress)
 	if err != nil {
-		logger.Fatalf("parse bind address error: %v\n", err)
+		return nil, fmt.Errorf("parse bind address `%s` error: %v", BindAddress, err)
+	}
+	cfg.BindAddress = BindAddress
+	if cfg.PasswordMetaKey == "" {
+		cfg.PasswordMetaKey = DefaultPasswordMetaKey
+	} else if strings.IndexFunc(cfg.PasswordMetaKey, unicode.IsSpace) >= 0 {
+		return nil, fmt.Errorf("invalid password meta key `%s`", cfg.PasswordMetaKey)
+	}
+	switch cfg.Network {
+	case "":
+		cfg.Network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unknown network `%s`, expect tcp, tcp4 or tcp6", cfg.Network)
+	}
+	if cfg.RateLimitStatus == 0 {
+		cfg.RateLimitStatus = http.StatusTooManyRequests
+	} else if cfg.RateLimitStatus < 400 || cfg.RateLimitStatus > 599 {
+		return nil, fmt.Errorf("rate limit status %d is not an http error status", cfg.RateLimitStatus)
+	}
+	switch cfg.ProxyNamePolicy {
+	case "", ProxyNameEnforce, ProxyNameWarn, ProxyNameOff:
+	default:
+		return nil, fmt.Errorf("unknown proxy name policy `%s`", cfg.ProxyNamePolicy)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("tls cert file and tls key file must be set together")
 	}
-	AuthMap, err := readAuthFile(cfg.AuthFile)
+	allowNets, err := parseIPNets(cfg.AllowCIDRs)
 	if err != nil {
-		logger.Fatalf("read auth file error: %v\n", err)
+		return nil, fmt.Errorf("parse allow cidrs error: %v", err)
 	}
-	m := &Map{
-		Data:        AuthMap,
-		Lock:        sync.RWMutex{},
-		RefreshChan: make(chan struct{}, 5),
+	denyNets, err := parseIPNets(cfg.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("parse deny cidrs error: %v", err)
 	}
-	wg := sync.WaitGroup{}
-	ctx, ctxFunc := context.WithCancel(context.Background())
+	trustedProxies, err := parseIPNets(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("parse trusted proxies error: %v", err)
+	}
+	if cfg.TrustForwarded && len(trustedProxies) == 0 {
+		return nil, errors.New("trust forwarded requires trusted proxies")
+	}
+	s := &Server{
+		cfg:            cfg,
+		logger:         logger,
+		refreshChan:    make(chan struct{}, 5),
+		proxies:        newProxyTracker(),
+		limiter:        newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+		userLimiter:    newRateLimiter(cfg.UserRateLimit, cfg.UserRateBurst),
+		allowNets:      allowNets,
+		denyNets:       denyNets,
+		trustedProxies: trustedProxies,
+	}
+	// release what was set up so far when a later step fails
+	defer func() {
+		if err != nil {
+			s.close()
+		}
+	}()
+	if cfg.MaxConcurrent > 0 {
+		s.sem = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	if cfg.DBPath != "" {
+		s.store, err = NewSQLiteStore(cfg.DBPath)
+		if err != nil {
+			return nil, fmt.Errorf("open sqlite database error: %v", err)
+		}
+	} else if cfg.RedisAddr != "" {
+		s.store = NewRedisStore(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, cfg.RedisChannel)
+	} else if cfg.LDAPURL != "" {
+		s.store, err = NewLDAPStore(cfg.LDAPURL, cfg.LDAPBindDN, cfg.LDAPBaseDN)
+		if err != nil {
+			return nil, fmt.Errorf("create ldap store error: %v", err)
+		}
+	} else if cfg.AuthData != "" {
+		// the data never changes, so there is nothing to watch or reload
+		if cfg.Inotify {
+			logger.Warn("inotify is disabled when reading auth data from the environment")
+		}
+		s.cfg.AuthFile = ""
+		s.cfg.Inotify = false
+		m := &Map{
+			AuthData:    []byte(cfg.AuthData),
+			PolicyFile:  cfg.PolicyFile,
+			Logger:      logger,
+			AllowEmpty:  cfg.AllowEmptyAuth,
+			LowerUsers:  cfg.CaseInsensitiveUser,
+			Lock:        sync.RWMutex{},
+			RefreshChan: s.refreshChan,
+		}
+		err = m.Reload()
+		if err != nil {
+			return nil, fmt.Errorf("read auth data error: %v", err)
+		}
+		s.store = m
+	} else {
+		s.authFiles = splitAuthFiles(cfg.AuthFile)
+		if len(s.authFiles) == 0 {
+			return nil, errors.New("auth file can not be empty")
+		}
+		m := &Map{
+			AuthFiles:       s.authFiles,
+			StagedFiles:     splitAuthFiles(cfg.StagedAuthFile),
+			URLToken:        cfg.AuthURLToken,
+			PolicyFile:      cfg.PolicyFile,
+			Logger:          logger,
+			AllowEmpty:      cfg.AllowEmptyAuth,
+			LowerUsers:      cfg.CaseInsensitiveUser,
+			SkipFailedFiles: cfg.SkipFailedAuthFiles,
+			Lock:            sync.RWMutex{},
+			RefreshChan:     s.refreshChan,
+		}
+		err = m.Reload()
+		if err != nil {
+			return nil, fmt.Errorf("read auth file error: %v", err)
+		}
+		s.store = m
+		// the staged files are watched too, they are loaded once promoted;
+		// urls can not be watched and are fetched every AuthURLInterval
+		s.authFiles = nil
+		for _, filename := range append(append([]string(nil), m.AuthFiles...), m.StagedFiles...) {
+			if isAuthURL(filename) {
+				s.authURLs = true
+			} else {
+				s.authFiles = append(s.authFiles, filename)
+			}
+		}
+	}
+	if _, ok := s.store.(*Map); !ok && cfg.CacheTTL > 0 {
+		s.store = NewCachedStore(s.store, cfg.CacheTTL)
+	}
+	// the credentials were loaded above
+	lastReload.SetToCurrentTime()
+	s.ready.Store(true)
+	if cfg.Metrics {
+		s.metrics = newMetricsHandler(s.store, s.proxies)
+	}
+	tracerProvider, tracerShutdown, err := newTracerProvider(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter error: %v", err)
+	}
+	s.tracer = tracerProvider.Tracer(tracerName)
+	s.tracerShutdown = tracerShutdown
+	s.server = newHTTPServer(&s.cfg, s.Handler())
+	if cfg.AdminAddr != "" {
+		AdminAddress, err := normalizeBindAddress(cfg.AdminAddr)
+		if err != nil {
+			return nil, fmt.Errorf("parse admin address `%s` error: %v", cfg.AdminAddr, err)
+		}
+		if cfg.AdminToken == "" {
+			return nil, errors.New("admin token is required by the admin api")
+		}
+		s.admin = newHTTPServer(&s.cfg, s.adminHandler())
+		s.admin.Addr = AdminAddress
+	}
+	// bind now, so that an address in use fails here rather than in Run
+	s.listener, err = listen(s.cfg.Network, s.cfg.BindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("listen on `%s` error: %v", s.cfg.BindAddress, err)
+	}
+	if s.admin != nil {
+		s.adminListener, err = listen(s.cfg.Network, s.admin.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen on `%s` error: %v", s.admin.Addr, err)
+		}
+	}
+	logger.Info("server initialized", "config", s.startupInfo())
+	return s, nil
+}
+
+// Handler returns the http.Handler serving the plugin requests along with
+// /healthz, /readyz and, if enabled, /version, /metrics, gzip and the access log.
+// Gzip encoded request bodies are always accepted.
+func (s *Server) Handler() http.Handler {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/healthz":
+			s.handleHealthz(w, r)
+		case r.URL.Path == "/readyz":
+			s.handleReadyz(w, r)
+		case r.URL.Path == "/version" && s.cfg.VersionEndpoint:
+			s.handleVersion(w, r)
+		case r.URL.Path == "/metrics" && s.metrics != nil:
+			s.metrics.ServeHTTP(w, r)
+		default:
+			s.handlePlugin(w, r)
+		}
+	})
+	if s.cfg.Gzip {
+		handler = gzipResponses(handler)
+	}
+	if s.cfg.AccessLog {
+		handler = accessLog(handler, s.logger, s.clientAddr)
+	}
+	return handler
+}
+
+// Refresh asks the server to reload its credentials.
+func (s *Server) Refresh() {
+	requestRefresh(s.refreshChan, s.logger)
+}
+
+// requestRefresh asks for a reload without blocking the caller, e.g. a
+// watcher which must keep reading its events. When refreshChan is full, a
+// reload is already pending and it will read the latest state.
+func requestRefresh(refreshChan chan struct{}, logger *slog.Logger) {
+	select {
+	case refreshChan <- struct{}{}:
+	default:
+		logger.Debug("reload already pending")
+	}
+}
+
+// Run serves until ctx is done or Stop is called, then shuts the server
+// down gracefully. Run returns immediately if the server was already stopped.
+func (s *Server) Run(ctx context.Context) error {
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return nil
+	}
+	ctx, ctxFunc := context.WithCancel(ctx)
 	defer ctxFunc()
-	if cfg.Inotify {
+	s.cancel = ctxFunc
+	s.done = make(chan struct{})
+	defer close(s.done)
+	s.lock.Unlock()
+	wg := sync.WaitGroup{}
+	var runErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			runErr = err
+		})
+		ctxFunc()
+	}
+	if s.cfg.Inotify && len(s.authFiles) > 0 {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := inotifyAuthFile(cfg.AuthFile, &m.RefreshChan, &ctx, &logger)
+			err := inotifyAuthFile(s.authFiles, &s.refreshChan, &ctx, s.logger)
 			if err != nil {
-				ctxFunc()
-				logger.Fatalf("inotify auth file error: %v\n", err)
-				return
+				s.logger.Error("inotify auth file error", "file", s.authFile(), "error", err)
+				fail(err)
 			}
 		}()
+	}
+	if s.cfg.PollInterval > 0 && len(s.authFiles) > 0 {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-m.RefreshChan:
-					AuthMap, err := readAuthFile(cfg.AuthFile)
-					if err != nil {
-						logger.Printf("read auth file error: %v\n", err)
-						continue
-					}
-					m.Lock.Lock()
-					m.Data = AuthMap
-					m.Lock.Unlock()
-				}
+			ticker := time.NewTicker(s.cfg.PollInterval)
+			defer ticker.Stop()
+			pollAuthFile(ctx, s.authFiles, ticker.C, s.refreshChan, s.logger)
+		}()
+	}
+	if s.cfg.AuthURLInterval > 0 && s.authURLs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refreshEvery(ctx, s.cfg.AuthURLInterval, s.refreshChan, s.logger)
+		}()
+	}
+	if rs, ok := unwrapStore(s.store).(*RedisStore); ok && rs.Channel != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rs.Subscribe(ctx, s.refreshChan, s.logger)
+		}()
+	}
+	// The reload consumer always runs, whatever the triggers: inotify,
+	// SIGHUP through Refresh, and the redis subscription all push to
+	// refreshChan.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.reloadLoop(ctx)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		s.logger.Info("shutting down...")
+		shutdownCtx, shutdownFunc := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer shutdownFunc()
+		err := s.shutdown(shutdownCtx)
+		if err != nil {
+			s.logger.Error("shutdown server error", "error", err)
+		}
+	}()
+	if s.admin != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.logger.Info("admin listen", "addr", s.admin.Addr)
+			err := s.serve(s.admin, s.adminListener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Error("admin server error", "error", err)
+				fail(err)
 			}
 		}()
 	}
-	server := http.Server{}
-	server.Addr = cfg.BindAddress
-	server.ErrorLog = nil
-	server.Handler = http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		Handler(w, r, m)
-	}))
-	logger.Println(fmt.Sprintf("listen on %s", cfg.BindAddress))
-	_ = server.ListenAndServe()
+	s.logger.Info("listen", "addr", s.cfg.BindAddress, "version", Version)
+	// ErrServerClosed is the normal outcome of a shutdown, anything else
+	// e.g. a bad tls certificate is returned
+	err := s.serve(s.server, s.listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("serve error", "error", err)
+		fail(err)
+	}
 	ctxFunc()
 	wg.Wait()
+	return runErr
+}
+
+// Stop shuts the server down, cancels the watchers started by Run and waits
+// for them to exit, or for ctx to be done. It is safe to call Stop before Run
+// and more than once.
+func (s *Server) Stop(ctx context.Context) error {
+	s.lock.Lock()
+	first := !s.stopped
+	s.stopped = true
+	cancel, done := s.cancel, s.done
+	s.lock.Unlock()
+	var err error
+	if first {
+		err = s.shutdown(ctx)
+	}
+	if cancel == nil {
+		return err
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+func (s *Server) serve(server *http.Server, ln net.Listener) error {
+	if s.cfg.TLSCertFile != "" {
+		return server.ServeTLS(ln, s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+	}
+	return server.Serve(ln)
 }
 
-func readAuthFile(filename string) (map[string]string, error) {
-	AuthDataBytes, err := os.ReadFile(filename)
+const unixSocketPrefix = "unix:"
+
+// listen listens on a tcp address of network, or on a unix socket for an
+// address such as `unix:/run/frp-multiuser.sock`. A stale socket left by a
+// previous run is replaced, while one another process still accepts on is
+// in use. The socket is made accessible to its group only, and it is
+// removed again when the listener is closed.
+func listen(network, addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen(network, addr)
+	}
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("unix socket `%s` is in use", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0660)
 	if err != nil {
+		_ = ln.Close()
 		return nil, err
 	}
-	AuthData := string(AuthDataBytes)
-	AuthData = strings.TrimRight(AuthData, "\r")
-	AuthMap := make(map[string]string)
-	for _, row := range strings.Split(AuthData, "\n") {
-		if strings.Contains(row, "=") {
-			kvs := strings.SplitN(row, "=", 2)
-			if strings.TrimSpace(kvs[1]) != "" {
-				AuthMap[strings.TrimSpace(kvs[0])] = strings.TrimSpace(kvs[1])
+	return ln, nil
+}
+
+// close releases the listeners, the tracer provider and the store of a
+// server which NewServer failed to set up.
+func (s *Server) close() {
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	if s.tracerShutdown != nil {
+		_ = s.tracerShutdown(context.Background())
+	}
+	if c, ok := unwrapStore(s.store).(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// shutdown shuts down the plugin server and, if enabled, the admin server.
+func (s *Server) shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	if s.admin != nil {
+		adminErr := s.admin.Shutdown(ctx)
+		if err == nil {
+			err = adminErr
+		}
+	}
+	// Shutdown only closes the listeners Run served, close them in case
+	// it never did
+	_ = s.listener.Close()
+	if s.adminListener != nil {
+		_ = s.adminListener.Close()
+	}
+	tracerErr := s.tracerShutdown(ctx)
+	if err == nil {
+		err = tracerErr
+	}
+	return err
+}
+
+func (s *Server) reload() {
+	_ = s.reloadStore()
+}
+
+// reloadStore reloads the store and logs the outcome.
+func (s *Server) reloadStore() error {
+	err := s.store.Reload()
+	reloadTotal.Inc()
+	if err != nil {
+		reloadErrors.Inc()
+	} else {
+		lastReload.SetToCurrentTime()
+	}
+	// an empty auth file is refused and the previous users are kept
+	s.ready.Store(err == nil || errors.Is(err, errEmptyAuthData))
+	if errors.Is(err, errEmptyAuthData) {
+		s.logger.Warn("reject empty auth file reload", "file", s.authFile(), "error", err)
+		return err
+	}
+	if err != nil {
+		s.logger.Error("read auth file error", "file", s.authFile(), "error", err)
+		return err
+	}
+	if uc, ok := s.store.(userCounter); ok {
+		s.logger.Info("auth file reloaded", "file", s.authFile(), "users", uc.Len())
+	} else {
+		s.logger.Info("auth store reloaded")
+	}
+	return nil
+}
+
+// authFile returns the auth files in use, which change when the staged ones
+// are promoted, redacted for logs and status output.
+func (s *Server) authFile() string {
+	if m, ok := s.store.(*Map); ok && m.AuthData == nil {
+		return redactAuthFiles(m.Files())
+	}
+	return redactAuthFiles(splitAuthFiles(s.cfg.AuthFile))
+}
+
+func (s *Server) reloadLoop(ctx context.Context) {
+	// Refresh signals arriving within the debounce window are coalesced
+	// into a single reload, which runs once the window has passed without
+	// new signals.
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.refreshChan:
+			if s.cfg.ReloadDebounce <= 0 {
+				s.reload()
+				continue
 			}
+			debounce = time.After(s.cfg.ReloadDebounce)
+		case <-debounce:
+			debounce = nil
+			s.reload()
 		}
 	}
-	return AuthMap, nil
 }
 
-func inotifyAuthFile(filename string, refreshChan *chan struct{}, ctx *context.Context, logger *log.Logger) error {
+// inotifyAuthFile watches the directories containing the auth files rather
+// than the files themselves, so that atomic saves and symlink swaps (e.g.
+// Kubernetes ConfigMap mounts) which replace the inode still trigger a reload.
+func inotifyAuthFile(filenames []string, refreshChan *chan struct{}, ctx *context.Context, logger *slog.Logger) error {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 	defer w.Close()
-	err = w.Add(filename)
-	if err != nil {
-		return err
+	realPaths := make(map[string]string)
+	for _, filename := range filenames {
+		filename = filepath.Clean(filename)
+		realPaths[filename], _ = filepath.EvalSymlinks(filename)
+		err = w.Add(filepath.Dir(filename))
+		if err != nil {
+			return err
+		}
 	}
 	for {
 		select {
 		case <-(*ctx).Done():
 			return nil
-		case event := <-w.Events:
-			switch event.Op {
-			case fsnotify.Write:
-				logger.Println("auth file changed, read again...")
-				*refreshChan <- struct{}{}
-			default:
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error("inotify auth file error", "error", err)
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			for filename, realPath := range realPaths {
+				currentPath, _ := filepath.EvalSymlinks(filename)
+				if filepath.Clean(event.Name) == filename || currentPath != realPath {
+					realPaths[filename] = currentPath
+					logger.Info("auth file changed, read again...", "file", filename, "event", event.Op.String())
+					requestRefresh(*refreshChan, logger)
+					break
+				}
 			}
 		}
 	}
 }
 
-func Handler(w http.ResponseWriter, r *http.Request, m *Map) {
-	var pluginRequest plugin.Request
-	var pluginLoginContent plugin.LoginContent
-	pluginRequest.Content = &pluginLoginContent
-	byteData, err := ioutil.ReadAll(r.Body)
-	_ = r.Body.Close()
+type fileState struct {
+	ModTime time.Time
+	Size    int64
+	Missing bool
+}
+
+func statFile(filename string) fileState {
+	info, err := os.Stat(filename)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf(`{"msg": "%s"}`, err.Error())))
-		return
+		return fileState{Missing: true}
 	}
-	err = json.Unmarshal(byteData, &pluginRequest)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte(fmt.Sprintf(`{"msg": "%s"}`, err.Error())))
-		return
-	}
-	var pluginResponse plugin.Response
-	user := pluginLoginContent.User
-	password := pluginLoginContent.Metas["password"]
-	if user == "" || password == "" {
-		pluginResponse.Reject = true
-		pluginResponse.RejectReason = "user or meta password can not be empty"
-		resp, err := json.Marshal(pluginResponse)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(fmt.Sprintf(`{"msg": "%s"}`, err.Error())))
+	return fileState{ModTime: info.ModTime(), Size: info.Size()}
+}
+
+// pollAuthFile checks the modification time and size of the auth files on
+// every tick and triggers a reload when they change, for filesystems where
+// inotify does not work, such as some network mounts.
+func pollAuthFile(ctx context.Context, filenames []string, tick <-chan time.Time, refreshChan chan struct{}, logger *slog.Logger) {
+	states := make(map[string]fileState)
+	for _, filename := range filenames {
+		states[filename] = statFile(filename)
+	}
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-tick:
+		}
+		changed := false
+		for _, filename := range filenames {
+			state := statFile(filename)
+			if state != states[filename] {
+				states[filename] = state
+				logger.Info("auth file changed, read again...", "file", filename, "event", "poll")
+				changed = true
+			}
+		}
+		if changed {
+			requestRefresh(refreshChan, logger)
 		}
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(resp)
-		return
 	}
-	m.Lock.RLock()
-	check := m.Data[user] == password
-	m.Lock.RUnlock()
-	if check {
-		pluginResponse.Unchange = true
-	} else {
-		pluginResponse.Reject = true
-		pluginResponse.RejectReason = fmt.Sprintf("user: `%s` invalid password", user)
+}
+
+// refreshEvery asks for a reload at every interval until ctx is done.
+func refreshEvery(ctx context.Context, interval time.Duration, refreshChan chan struct{}, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		requestRefresh(refreshChan, logger)
+	}
+}
+
+func newHTTPServer(cfg *Config, handler http.Handler) *http.Server {
+	orDefault := func(d, def time.Duration) time.Duration {
+		if d <= 0 {
+			return def
+		}
+		return d
+	}
+	idleTimeout := orDefault(cfg.IdleTimeout, defaultIdleTimeout)
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: idleTimeout})
+	}
+	server := &http.Server{
+		Addr:              cfg.BindAddress,
+		Handler:           handler,
+		ReadHeaderTimeout: orDefault(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       orDefault(cfg.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      orDefault(cfg.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       idleTimeout,
+	}
+	server.SetKeepAlivesEnabled(!cfg.DisableKeepAlives)
+	return server
+}
+
+// normalizeBindAddress turns a bare port such as `7003` or `:7003` into
+// `[::]:7003` and validates the result. Unix socket addresses are kept as is.
+func normalizeBindAddress(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		if strings.TrimPrefix(addr, unixSocketPrefix) == "" {
+			return addr, errors.New("empty unix socket path")
+		}
+		return addr, nil
+	}
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
 	}
-	resp, err := json.Marshal(pluginResponse)
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf(`{"msg": "%s"}`, err.Error())))
-		return
+		return addr, err
+	}
+	if host == "" {
+		host = "::"
+	}
+	addr = net.JoinHostPort(host, port)
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return addr, fmt.Errorf("invalid port `%s`", port)
+	}
+	return addr, nil
+}
+
+func newLogger(format, level string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{}
+	if level != "" {
+		var logLevel slog.Level
+		err := logLevel.UnmarshalText([]byte(level))
+		if err != nil {
+			return nil, fmt.Errorf("unknown log level `%s`", level)
+		}
+		opts.Level = logLevel
+	}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format `%s`", format)
 	}
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(resp)
-	return
 }
@@ -0,0 +1,486 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeBindAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "7003", want: "[::]:7003"},
+		{addr: ":7003", want: "[::]:7003"},
+		{addr: " 7003 ", want: "[::]:7003"},
+		{addr: "0.0.0.0:7003", want: "0.0.0.0:7003"},
+		{addr: "[::1]:7003", want: "[::1]:7003"},
+		{addr: "localhost:7003", want: "localhost:7003"},
+		{addr: "unix:/run/frp-multiuser.sock", want: "unix:/run/frp-multiuser.sock"},
+		{addr: "unix:", wantErr: true},
+		{addr: "70000", wantErr: true},
+		{addr: "http", wantErr: true},
+		{addr: "::1:7003", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeBindAddress(tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeBindAddress(%q) error = %v, want error %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("normalizeBindAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRefreshReloadsWithoutInotify(t *testing.T) {
+	filename := writeTestFile(t, "tokens", "alice=x\n")
+	s := newTestServer(t, Config{AuthFile: filename})
+	go func() { _ = s.Run(context.Background()) }()
+	if err := os.WriteFile(filename, []byte("alice=y\n"), 0600); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	s.Refresh()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ok, _ := s.store.Verify("alice", "y"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new password not loaded after Refresh()")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ok, _ := s.store.Verify("alice", "x"); ok {
+		t.Error("old password still valid after Refresh()")
+	}
+}
+
+func TestRequestRefreshNeverBlocks(t *testing.T) {
+	refreshChan := make(chan struct{}, 1)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			requestRefresh(refreshChan, logger)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requestRefresh() blocked on a full channel")
+	}
+	if n := len(refreshChan); n != 1 {
+		t.Errorf("%d pending reloads, want 1", n)
+	}
+}
+
+// openFiles counts the file descriptors of the process open on filename.
+func openFiles(t *testing.T, filename string) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("list open files error = %v", err)
+	}
+	n := 0
+	for _, entry := range entries {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name())); err == nil && target == filename {
+			n++
+		}
+	}
+	return n
+}
+
+func TestNewServerAddressInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	defer ln.Close()
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	_, err = NewServer(Config{DBPath: dbPath, BindAddress: ln.Addr().String(), Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err == nil || !strings.Contains(err.Error(), "listen on") {
+		t.Fatalf("NewServer() on an address in use error = %v, want a listen error", err)
+	}
+	if n := openFiles(t, dbPath); n != 0 {
+		t.Errorf("%d files open on the database after NewServer() failed, want 0", n)
+	}
+}
+
+func TestNewServerAdminErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{name: "invalid admin address", cfg: Config{AdminAddr: "70000", AdminToken: "admin"}, wantErr: "parse admin address `70000`"},
+		{name: "missing admin token", cfg: Config{AdminAddr: "127.0.0.1:0"}, wantErr: "admin token is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "users.db")
+			tt.cfg.DBPath = dbPath
+			tt.cfg.BindAddress = "127.0.0.1:0"
+			tt.cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+			_, err := NewServer(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("NewServer() error = %v, want error containing %q", err, tt.wantErr)
+			}
+			if n := openFiles(t, dbPath); n != 0 {
+				t.Errorf("%d files open on the database after NewServer() failed, want 0", n)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin.sock")
+	s := newTestServer(t, Config{AuthData: "alice=x", BindAddress: unixSocketPrefix + path})
+	go func() { _ = s.Run(context.Background()) }()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := LoginWithClient(client, "http://unix/handler", "alice", "x")
+	if err != nil {
+		t.Fatalf("LoginWithClient() error = %v", err)
+	}
+	if resp.Reject {
+		t.Errorf("login over the unix socket rejected: %s", resp.RejectReason)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %v, %v, want 0660", info.Mode().Perm(), err)
+	}
+
+	_, err = NewServer(Config{AuthData: "alice=x", BindAddress: unixSocketPrefix + path, Logger: s.logger})
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("NewServer() on a served socket error = %v, want in use", err)
+	}
+	if _, err := LoginWithClient(client, "http://unix/handler", "alice", "x"); err != nil {
+		t.Errorf("login after the second NewServer() error = %v, want the socket still served", err)
+	}
+}
+
+func TestUnixSocketReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = ln.Close()
+	newTestServer(t, Config{AuthData: "alice=x", BindAddress: unixSocketPrefix + path})
+}
+
+func TestPollAuthFile(t *testing.T) {
+	filename := writeTestFile(t, "tokens", "alice=x\n")
+	modTime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatalf("chtimes error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tick := make(chan time.Time)
+	refreshChan := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pollAuthFile(ctx, []string{filename}, tick, refreshChan, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	tests := []struct {
+		name    string
+		change  func() error
+		refresh bool
+	}{
+		{name: "unchanged", change: func() error { return nil }},
+		{name: "mtime", change: func() error {
+			return os.Chtimes(filename, modTime.Add(time.Second), modTime.Add(time.Second))
+		}, refresh: true},
+		{name: "size", change: func() error {
+			// the same mtime, so only the size tells the change
+			if err := os.WriteFile(filename, []byte("alice=xy\n"), 0600); err != nil {
+				return err
+			}
+			return os.Chtimes(filename, modTime.Add(time.Second), modTime.Add(time.Second))
+		}, refresh: true},
+		{name: "removed", change: func() error { return os.Remove(filename) }, refresh: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); err != nil {
+				t.Fatalf("change error = %v", err)
+			}
+			tick <- time.Now()
+			// the second tick returns once the first poll is done
+			tick <- time.Now()
+			select {
+			case <-refreshChan:
+				if !tt.refresh {
+					t.Error("reload requested, want none")
+				}
+			default:
+				if tt.refresh {
+					t.Error("no reload requested, want one")
+				}
+			}
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key,
+// and returns their files with a pool trusting the certificate.
+func writeTestCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "frp-multiuser test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate error = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key error = %v", err)
+	}
+	certFile = writeTestFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeTestFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestTLS(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	s := newTestServer(t, Config{AuthData: "alice=x", TLSCertFile: certFile, TLSKeyFile: keyFile})
+	go func() { _ = s.Run(context.Background()) }()
+	endpoint := "https://" + s.listener.Addr().String() + "/handler"
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := LoginWithClient(client, endpoint, "alice", "x")
+	if err != nil {
+		t.Fatalf("LoginWithClient() over https error = %v", err)
+	}
+	if resp.Reject {
+		t.Errorf("login over https rejected: %s", resp.RejectReason)
+	}
+	if _, err := LoginWithClient(http.DefaultClient, "http://"+s.listener.Addr().String()+"/handler", "alice", "x"); err == nil {
+		t.Error("LoginWithClient() over plain http error = nil, want error")
+	}
+	if _, err := LoginWithClient(http.DefaultClient, endpoint, "alice", "x"); err == nil {
+		t.Error("LoginWithClient() without trusting the certificate error = nil, want error")
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	certFile, _, _ := writeTestCert(t)
+	_, err := NewServer(Config{AuthData: "alice=x", BindAddress: "127.0.0.1:0", TLSCertFile: certFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Errorf("NewServer() with a cert and no key error = %v, want an error", err)
+	}
+
+	s := newTestServer(t, Config{AuthData: "alice=x", TLSCertFile: certFile, TLSKeyFile: certFile})
+	errChan := make(chan error, 1)
+	go func() { errChan <- s.Run(context.Background()) }()
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Error("Run() with an invalid key error = nil, want error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() with an invalid key did not return")
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name                          string
+		cfg                           Config
+		readHeader, read, write, idle time.Duration
+	}{
+		{
+			name:       "defaults",
+			readHeader: defaultReadHeaderTimeout, read: defaultReadTimeout, write: defaultWriteTimeout, idle: defaultIdleTimeout,
+		},
+		{
+			name:       "configured",
+			cfg:        Config{ReadHeaderTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second, IdleTimeout: 4 * time.Second},
+			readHeader: time.Second, read: 2 * time.Second, write: 3 * time.Second, idle: 4 * time.Second,
+		},
+		{
+			name:       "negative",
+			cfg:        Config{ReadTimeout: -time.Second, IdleTimeout: -time.Second},
+			readHeader: defaultReadHeaderTimeout, read: defaultReadTimeout, write: defaultWriteTimeout, idle: defaultIdleTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.AuthData = "alice=x"
+			server := newTestServer(t, tt.cfg).server
+			if server.ReadHeaderTimeout != tt.readHeader || server.ReadTimeout != tt.read || server.WriteTimeout != tt.write || server.IdleTimeout != tt.idle {
+				t.Errorf("timeouts = %v, %v, %v, %v, want %v, %v, %v, %v",
+					server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout,
+					tt.readHeader, tt.read, tt.write, tt.idle)
+			}
+		})
+	}
+}
+
+func TestReadHeaderTimeoutClosesSlowRequests(t *testing.T) {
+	s := newTestServer(t, Config{AuthData: "alice=x", ReadHeaderTimeout: 100 * time.Millisecond})
+	go func() { _ = s.Run(context.Background()) }()
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer conn.Close()
+	// the request line without the end of the headers
+	if _, err := io.WriteString(conn, "POST /handler HTTP/1.1\r\nHost: plugin\r\n"); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("read error = %v, want the server to close the connection", err)
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	tests := []struct {
+		name              string
+		disableKeepAlives bool
+		reused            bool
+	}{
+		{name: "keep-alive", reused: true},
+		{name: "disabled", disableKeepAlives: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", DisableKeepAlives: tt.disableKeepAlives})
+			go func() { _ = s.Run(context.Background()) }()
+			client := &http.Client{Transport: &http.Transport{}}
+			reused := false
+			for i := 0; i < 2; i++ {
+				r, err := http.NewRequest(http.MethodGet, "http://"+s.listener.Addr().String()+"/healthz", nil)
+				if err != nil {
+					t.Fatalf("NewRequest() error = %v", err)
+				}
+				r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+					GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+				}))
+				resp, err := client.Do(r)
+				if err != nil {
+					t.Fatalf("GET /healthz error = %v", err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+				if resp.Close != tt.disableKeepAlives {
+					t.Errorf("Connection: close = %v, want %v", resp.Close, tt.disableKeepAlives)
+				}
+			}
+			if reused != tt.reused {
+				t.Errorf("second request reused the connection = %v, want %v", reused, tt.reused)
+			}
+		})
+	}
+}
+
+func TestRunReturnsServeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(s *Server) error
+	}{
+		{name: "plugin listener", close: func(s *Server) error { return s.listener.Close() }},
+		{name: "admin listener", close: func(s *Server) error { return s.adminListener.Close() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "alice=x", AdminAddr: "127.0.0.1:0", AdminToken: "admin"})
+			// a listener which fails to accept
+			if err := tt.close(s); err != nil {
+				t.Fatalf("close error = %v", err)
+			}
+			errChan := make(chan error, 1)
+			go func() { errChan <- s.Run(context.Background()) }()
+			select {
+			case err := <-errChan:
+				if err == nil {
+					t.Error("Run() error = nil, want the serve error")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not return on a serve error")
+			}
+		})
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		network string
+		addr    string
+		wantErr string
+	}{
+		{network: "tcp4", addr: "127.0.0.1:0"},
+		{network: "tcp", addr: "127.0.0.1:0"},
+		{network: "tcp4", addr: "[::1]:0", wantErr: "listen on"},
+		{network: "udp", addr: "127.0.0.1:0", wantErr: "unknown network `udp`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network+" "+tt.addr, func(t *testing.T) {
+			s, err := NewServer(Config{AuthData: "alice=x", Network: tt.network, BindAddress: tt.addr, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NewServer() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewServer() error = %v", err)
+			}
+			defer s.Stop(context.Background())
+			if network := s.listener.Addr().Network(); network != "tcp" {
+				t.Errorf("listener network = %s, want tcp", network)
+			}
+			if ip := s.listener.Addr().(*net.TCPAddr).IP; ip.To4() == nil {
+				t.Errorf("listener ip = %v, want ipv4", ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AuthStore is a source of user credentials used by Handler.
+type AuthStore interface {
+	Verify(user, password string) (bool, error)
+	Reload() error
+}
+
+// ContextAuthStore is implemented by stores which can give up on a Verify
+// when ctx is done, e.g. network backed ones.
+type ContextAuthStore interface {
+	VerifyContext(ctx context.Context, user, password string) (bool, error)
+}
+
+// verifyContext verifies with ctx if the store supports it.
+func verifyContext(ctx context.Context, store AuthStore, user, password string) (bool, error) {
+	if cs, ok := store.(ContextAuthStore); ok {
+		return cs.VerifyContext(ctx, user, password)
+	}
+	return store.Verify(user, password)
+}
+
+// PolicyStore is implemented by stores that carry per-user policies.
+type PolicyStore interface {
+	Policy(user string) *Policy
+}
+
+var errEmptyAuthData = errors.New("auth file has no users, keep the previous users")
+
+var errNoStagedFiles = errors.New("no staged auth file")
+
+type userCounter interface {
+	Len() int
+}
+
+// pinger is implemented by the stores backed by a service, checking that it
+// is reachable.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Map is the default AuthStore, backed by the auth file. A user in the auth
+// file may be a glob pattern such as `ci-*`, standing for every user it
+// matches which has no entry of its own. When several patterns match, the
+// longest one wins, and patterns of the same length are tried in sort order.
+type Map struct {
+	Data      map[string][]string
+	Policies  map[string]*Policy
+	AuthFiles []string
+	// URLToken is the bearer token sent when fetching auth files which are
+	// http(s) URLs.
+	URLToken string
+	// StagedFiles are auth files which Promote swaps with AuthFiles, e.g. a
+	// new set of credentials checked with -validate before going live.
+	StagedFiles []string
+	// AuthData is read instead of AuthFiles when set, e.g. credentials
+	// passed in the environment.
+	AuthData   []byte
+	PolicyFile string
+	Logger     *slog.Logger
+	// AllowEmpty lets a reload replace the loaded users with an empty set.
+	// Otherwise such a reload is rejected and the previous users are kept,
+	// so that a truncated file can not lock everyone out.
+	AllowEmpty bool
+	// LowerUsers lowercases the users read from the auth file.
+	LowerUsers bool
+	// SkipFailedFiles loads the auth files which can be read when others
+	// fail, rather than failing the whole load. A failed file is logged and
+	// keeps the users it had at the previous load, none at the first one.
+	SkipFailedFiles bool
+	RefreshChan     chan struct{}
+	Lock            sync.RWMutex
+	// Entries holds the auth file entries as read, before the inline
+	// policies are split off, so that Update can write them back.
+	Entries map[string][]string
+
+	patterns    []string
+	dummy       string
+	updateLock  sync.Mutex
+	fileEntries map[string]map[string][]string
+}
+
+// resolve returns the entry standing for user, either the user itself or
+// the pattern matching it. m.Lock must be held.
+func (m *Map) resolve(user string) (string, bool) {
+	if _, ok := m.Data[user]; ok {
+		return user, true
+	}
+	for _, pattern := range m.patterns {
+		if matched, _ := path.Match(pattern, user); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func (m *Map) Verify(user, password string) (bool, error) {
+	m.Lock.RLock()
+	key, ok := m.resolve(user)
+	passwords := m.Data[key]
+	dummy := m.dummy
+	m.Lock.RUnlock()
+	if !ok {
+		if dummy == "" {
+			dummy = dummyPassword
+		}
+		passwords = []string{dummy}
+	}
+	// check every password, so that the time taken does not reveal which
+	// one matched
+	check := false
+	for _, stored := range passwords {
+		if verifyPassword(stored, password) {
+			check = true
+		}
+	}
+	return check && ok, nil
+}
+
+func (m *Map) Len() int {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	return len(m.Data)
+}
+
+func (m *Map) Policy(user string) *Policy {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	key, ok := m.resolve(user)
+	if !ok {
+		return nil
+	}
+	return m.Policies[key]
+}
+
+func (m *Map) Reload() error {
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+	return m.reload()
+}
+
+// reload loads the users. m.updateLock must be held.
+func (m *Map) reload() error {
+	var AuthMap map[string][]string
+	var duplicates []string
+	var err error
+	if m.AuthData != nil {
+		AuthMap, err = parseAuthData(m.AuthData)
+	} else {
+		AuthMap, duplicates, err = m.readAuthFiles()
+	}
+	if err != nil {
+		return err
+	}
+	if m.Logger != nil {
+		for _, user := range duplicates {
+			m.Logger.Warn("duplicate user in auth files, last file wins", "user", user)
+		}
+	}
+	PasswordMap, PolicyMap, err := m.build(AuthMap)
+	if err != nil {
+		return err
+	}
+	m.Lock.RLock()
+	loaded := m.Data != nil
+	added, removed, modified := diffUsers(m.Data, PasswordMap)
+	m.Lock.RUnlock()
+	err = m.swap(AuthMap, PasswordMap, PolicyMap)
+	if err != nil {
+		return err
+	}
+	if m.Logger != nil && loaded {
+		m.Logger.Info(fmt.Sprintf("reload: +%d -%d ~%d users", added, removed, modified), "added", added, "removed", removed, "modified", modified)
+	}
+	return nil
+}
+
+// Files returns the auth files currently loaded.
+func (m *Map) Files() []string {
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+	return m.AuthFiles
+}
+
+// Promote makes the staged auth files the loaded ones and loads them, the
+// previous auth files becoming the staged ones so that a second Promote
+// rolls back. The staged files must all load, otherwise nothing changes.
+func (m *Map) Promote() error {
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+	if len(m.StagedFiles) == 0 {
+		return errNoStagedFiles
+	}
+	_, _, err := readAuthFiles(m.StagedFiles, m.URLToken)
+	if err != nil {
+		return err
+	}
+	m.AuthFiles, m.StagedFiles = m.StagedFiles, m.AuthFiles
+	err = m.reload()
+	if err != nil {
+		m.AuthFiles, m.StagedFiles = m.StagedFiles, m.AuthFiles
+		return err
+	}
+	if m.Logger != nil {
+		m.Logger.Info("staged auth file promoted", "file", redactAuthFiles(m.AuthFiles), "staged_file", redactAuthFiles(m.StagedFiles))
+	}
+	return nil
+}
+
+// readAuthFiles reads the auth files, skipping the failed ones if
+// SkipFailedFiles is set. m.updateLock must be held.
+func (m *Map) readAuthFiles() (map[string][]string, []string, error) {
+	if !m.SkipFailedFiles {
+		return readAuthFiles(m.AuthFiles, m.URLToken)
+	}
+	fileEntries := make(map[string]map[string][]string, len(m.AuthFiles))
+	FileAuthMaps := make([]map[string][]string, 0, len(m.AuthFiles))
+	failed := 0
+	for _, filename := range m.AuthFiles {
+		FileAuthMap, err := readAuthFile(filename, m.URLToken)
+		if err != nil {
+			failed++
+			FileAuthMap = m.fileEntries[filename]
+			if m.Logger != nil {
+				m.Logger.Error("read auth file error, skip it", "file", redactAuthFile(filename), "previous_users", len(FileAuthMap), "error", err)
+			}
+		}
+		if FileAuthMap != nil {
+			fileEntries[filename] = FileAuthMap
+			FileAuthMaps = append(FileAuthMaps, FileAuthMap)
+		}
+	}
+	if failed == len(m.AuthFiles) {
+		return nil, nil, errors.New("no auth file could be read")
+	}
+	AuthMap, duplicates := mergeAuthMaps(FileAuthMaps)
+	m.fileEntries = fileEntries
+	return AuthMap, duplicates, nil
+}
+
+// diffUsers counts the users added, removed and with changed passwords
+// between two password maps.
+func diffUsers(OldMap, NewMap map[string][]string) (added, removed, modified int) {
+	for user, passwords := range NewMap {
+		oldPasswords, ok := OldMap[user]
+		if !ok {
+			added++
+			continue
+		}
+		if !equalStrings(oldPasswords, passwords) {
+			modified++
+		}
+	}
+	for user := range OldMap {
+		if _, ok := NewMap[user]; !ok {
+			removed++
+		}
+	}
+	return added, removed, modified
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Users returns the sorted names of the loaded users.
+func (m *Map) Users() []string {
+	m.Lock.RLock()
+	users := make([]string, 0, len(m.Data))
+	for user := range m.Data {
+		users = append(users, user)
+	}
+	m.Lock.RUnlock()
+	sort.Strings(users)
+	return users
+}
+
+// Update applies fn to a copy of the auth file entries, writes the result
+// back to the auth file and loads it. An error from fn aborts the update. Only a single auth file can be
+// updated, since the entries of several files are merged.
+func (m *Map) Update(fn func(AuthMap map[string][]string) error) error {
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+	if len(m.AuthFiles) != 1 || m.AuthData != nil || isAuthURL(m.AuthFiles[0]) {
+		return errors.New("only a single auth file can be updated")
+	}
+	m.Lock.RLock()
+	AuthMap := make(map[string][]string, len(m.Entries))
+	for user, entries := range m.Entries {
+		AuthMap[user] = entries
+	}
+	m.Lock.RUnlock()
+	err := fn(AuthMap)
+	if err != nil {
+		return err
+	}
+	PasswordMap, PolicyMap, err := m.build(AuthMap)
+	if err != nil {
+		return err
+	}
+	m.Lock.RLock()
+	empty := len(PasswordMap) == 0 && len(m.Data) > 0 && !m.AllowEmpty
+	m.Lock.RUnlock()
+	if empty {
+		return errEmptyAuthData
+	}
+	err = writeAuthFile(m.AuthFiles[0], AuthMap)
+	if err != nil {
+		return err
+	}
+	return m.swap(AuthMap, PasswordMap, PolicyMap)
+}
+
+// build turns the auth file entries into the passwords and policies of the
+// users, merging in the policy file.
+func (m *Map) build(AuthMap map[string][]string) (map[string][]string, map[string]*Policy, error) {
+	PasswordMap, PolicyMap, err := splitAuthMap(AuthMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	for user := range PasswordMap {
+		if _, err := path.Match(user, ""); isUserPattern(user) && err != nil {
+			return nil, nil, fmt.Errorf("user `%s`: invalid pattern", user)
+		}
+	}
+	if m.LowerUsers {
+		PasswordMap, PolicyMap = m.lowerUsers(PasswordMap, PolicyMap)
+	}
+	if m.PolicyFile != "" {
+		FilePolicyMap, err := readPolicyFile(m.PolicyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m.LowerUsers {
+			LowerFilePolicyMap := make(map[string]*Policy, len(FilePolicyMap))
+			for user, policy := range FilePolicyMap {
+				LowerFilePolicyMap[strings.ToLower(user)] = policy
+			}
+			FilePolicyMap = LowerFilePolicyMap
+		}
+		mergePolicies(PolicyMap, FilePolicyMap)
+	}
+	return PasswordMap, PolicyMap, nil
+}
+
+func (m *Map) swap(AuthMap map[string][]string, PasswordMap map[string][]string, PolicyMap map[string]*Policy) error {
+	// hashing the dummy may take a while, do it before taking the lock
+	dummy := mapDummyHash(PasswordMap)
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if len(PasswordMap) == 0 && len(m.Data) > 0 && !m.AllowEmpty {
+		return errEmptyAuthData
+	}
+	m.Entries = AuthMap
+	m.Data = PasswordMap
+	m.Policies = PolicyMap
+	m.dummy = dummy
+	m.patterns = m.patterns[:0]
+	for user := range PasswordMap {
+		if isUserPattern(user) {
+			m.patterns = append(m.patterns, user)
+		}
+	}
+	sort.Slice(m.patterns, func(i, j int) bool {
+		if len(m.patterns[i]) != len(m.patterns[j]) {
+			return len(m.patterns[i]) > len(m.patterns[j])
+		}
+		return m.patterns[i] < m.patterns[j]
+	})
+	return nil
+}
+
+func isUserPattern(user string) bool {
+	return strings.ContainsAny(user, "*?[")
+}
+
+// lowerUsers lowercases the users of the password and policy maps. When two
+// users collide the last one in sort order wins, and a warning is logged.
+func (m *Map) lowerUsers(PasswordMap map[string][]string, PolicyMap map[string]*Policy) (map[string][]string, map[string]*Policy) {
+	users := make([]string, 0, len(PasswordMap))
+	for user := range PasswordMap {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	LowerPasswordMap := make(map[string][]string, len(PasswordMap))
+	LowerPolicyMap := make(map[string]*Policy, len(PolicyMap))
+	for _, user := range users {
+		lower := strings.ToLower(user)
+		if _, ok := LowerPasswordMap[lower]; ok && m.Logger != nil {
+			m.Logger.Warn("users collide after lowercasing, last one wins", "user", user, "lower", lower)
+		}
+		LowerPasswordMap[lower] = PasswordMap[user]
+		if policy, ok := PolicyMap[user]; ok {
+			LowerPolicyMap[lower] = policy
+		} else {
+			delete(LowerPolicyMap, lower)
+		}
+	}
+	return LowerPasswordMap, LowerPolicyMap
+}
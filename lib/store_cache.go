@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const cacheSize = 10000
+
+// CachedStore wraps a network backed AuthStore and remembers verification
+// results, successful ones for TTL and failed ones for NegativeTTL, which
+// should be shorter so that a fixed password works again quickly. Only the
+// most recently used cacheSize results are kept. Entries are keyed by an
+// HMAC of the user and password under a random key of the cache, so no
+// password is held in the clear and the keys cannot be checked against
+// guessed passwords without that key.
+type CachedStore struct {
+	Store       AuthStore
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	hashKey     []byte
+	items       map[[sha256.Size]byte]*list.Element
+	order       *list.List
+	lock        sync.Mutex
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	ok      bool
+	expires time.Time
+}
+
+// NewCachedStore caches the results of store. Failed verifications are
+// cached for a tenth of ttl.
+func NewCachedStore(store AuthStore, ttl time.Duration) *CachedStore {
+	hashKey := make([]byte, sha256.Size)
+	if _, err := rand.Read(hashKey); err != nil {
+		panic(fmt.Sprintf("read random cache key error: %v", err))
+	}
+	return &CachedStore{
+		Store:       store,
+		TTL:         ttl,
+		NegativeTTL: ttl / 10,
+		hashKey:     hashKey,
+		items:       make(map[[sha256.Size]byte]*list.Element),
+		order:       list.New(),
+	}
+}
+
+func (c *CachedStore) Verify(user, password string) (bool, error) {
+	return c.VerifyContext(context.Background(), user, password)
+}
+
+func (c *CachedStore) VerifyContext(ctx context.Context, user, password string) (bool, error) {
+	var key [sha256.Size]byte
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write([]byte(user + "\x00" + password))
+	mac.Sum(key[:0])
+	c.lock.Lock()
+	if element, ok := c.items[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if now().Before(entry.expires) {
+			c.order.MoveToFront(element)
+			c.lock.Unlock()
+			return entry.ok, nil
+		}
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+	c.lock.Unlock()
+	check, err := verifyContext(ctx, c.Store, user, password)
+	if err != nil {
+		// backend errors are not cached
+		return check, err
+	}
+	ttl := c.TTL
+	if !check {
+		ttl = c.NegativeTTL
+	}
+	if ttl <= 0 {
+		return check, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.order.Remove(element)
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, ok: check, expires: now().Add(ttl)})
+	if c.order.Len() > cacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+	return check, nil
+}
+
+// Reload drops the cache and reloads the wrapped store.
+func (c *CachedStore) Reload() error {
+	c.lock.Lock()
+	c.items = make(map[[sha256.Size]byte]*list.Element)
+	c.order.Init()
+	c.lock.Unlock()
+	return c.Store.Reload()
+}
+
+// Unwrap returns the wrapped store.
+func (c *CachedStore) Unwrap() AuthStore {
+	return c.Store
+}
+
+// unwrapStore returns the store below any CachedStore.
+func unwrapStore(store AuthStore) AuthStore {
+	if c, ok := store.(*CachedStore); ok {
+		return c.Unwrap()
+	}
+	return store
+}
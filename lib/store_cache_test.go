@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingStore accepts alice=x and counts the verifications reaching it.
+type countingStore struct {
+	calls int
+	err   error
+}
+
+func (s *countingStore) Verify(user, password string) (bool, error) {
+	s.calls++
+	return user == "alice" && password == "x", s.err
+}
+
+func (s *countingStore) Reload() error {
+	return nil
+}
+
+func TestCachedStoreHits(t *testing.T) {
+	backend := &countingStore{}
+	c := NewCachedStore(backend, time.Minute)
+	tests := []struct {
+		user, password string
+		want           bool
+		calls          int
+	}{
+		{user: "alice", password: "x", want: true, calls: 1},
+		{user: "alice", password: "x", want: true, calls: 1},
+		{user: "alice", password: "y", want: false, calls: 2},
+		{user: "alice", password: "y", want: false, calls: 2},
+		{user: "bob", password: "x", want: false, calls: 3},
+	}
+	for _, tt := range tests {
+		ok, err := c.Verify(tt.user, tt.password)
+		if err != nil || ok != tt.want {
+			t.Errorf("Verify(%s, %s) = %v, %v, want %v", tt.user, tt.password, ok, err, tt.want)
+		}
+		if backend.calls != tt.calls {
+			t.Errorf("after Verify(%s, %s) %d backend calls, want %d", tt.user, tt.password, backend.calls, tt.calls)
+		}
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	_, _ = c.Verify("alice", "x")
+	if backend.calls != 4 {
+		t.Errorf("%d backend calls after Reload(), want 4", backend.calls)
+	}
+}
+
+func TestCachedStoreExpiry(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	start := time.Unix(1700000000, 0)
+	now = func() time.Time { return start }
+
+	backend := &countingStore{}
+	c := NewCachedStore(backend, time.Minute)
+	_, _ = c.Verify("alice", "x")
+	_, _ = c.Verify("alice", "y")
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		password string
+		calls    int
+	}{
+		{name: "success within TTL", elapsed: 59 * time.Second, password: "x", calls: 2},
+		{name: "failure past NegativeTTL", elapsed: 6 * time.Second, password: "y", calls: 3},
+		{name: "success past TTL", elapsed: time.Minute, password: "x", calls: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = func() time.Time { return start.Add(tt.elapsed) }
+			_, _ = c.Verify("alice", tt.password)
+			if backend.calls != tt.calls {
+				t.Errorf("%d backend calls, want %d", backend.calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestCachedStoreSkipsErrors(t *testing.T) {
+	backend := &countingStore{err: errors.New("backend down")}
+	c := NewCachedStore(backend, time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Verify("alice", "x"); err == nil {
+			t.Fatal("Verify() error = nil, want the backend error")
+		}
+	}
+	if backend.calls != 2 {
+		t.Errorf("%d backend calls, want 2 with errors not cached", backend.calls)
+	}
+}
+
+func TestCachedStoreKeys(t *testing.T) {
+	first := NewCachedStore(&countingStore{}, time.Minute)
+	second := NewCachedStore(&countingStore{}, time.Minute)
+	_, _ = first.Verify("alice", "x")
+	_, _ = second.Verify("alice", "x")
+	for key := range first.items {
+		if _, ok := second.items[key]; ok {
+			t.Error("two caches key alice=x alike, want a random key per cache")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"strings"
+	"time"
+)
+
+const ldapTimeout = 5 * time.Second
+
+// LDAPStore is an AuthStore verifying credentials by binding to an LDAP
+// server as the user. BindDN is a template where `%s` is replaced with the
+// escaped user name; when it is empty `uid=%s,<BaseDN>` is used.
+type LDAPStore struct {
+	URL    string
+	BindDN string
+	BaseDN string
+}
+
+func NewLDAPStore(url, bindDN, baseDN string) (*LDAPStore, error) {
+	if bindDN == "" {
+		if baseDN == "" {
+			return nil, fmt.Errorf("ldap bind dn template or base dn must be set")
+		}
+		bindDN = "uid=%s," + baseDN
+	}
+	if strings.Count(bindDN, "%s") != 1 {
+		return nil, fmt.Errorf("ldap bind dn template must contain exactly one %%s")
+	}
+	return &LDAPStore{
+		URL:    url,
+		BindDN: bindDN,
+		BaseDN: baseDN,
+	}, nil
+}
+
+func (s *LDAPStore) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(s.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	return conn, nil
+}
+
+func (s *LDAPStore) Verify(user, password string) (bool, error) {
+	return s.VerifyContext(context.Background(), user, password)
+}
+
+// VerifyContext closes the connection when ctx is done, since the ldap
+// client does not take a context.
+func (s *LDAPStore) VerifyContext(ctx context.Context, user, password string) (bool, error) {
+	// An empty password is an unauthenticated bind, which many servers
+	// accept for any dn.
+	if password == "" {
+		return false, nil
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Bind(fmt.Sprintf(s.BindDN, ldap.EscapeDN(user)), password)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		conn.Close()
+		return false, ctx.Err()
+	}
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *LDAPStore) Reload() error {
+	return s.Ping(context.Background())
+}
+
+// Ping dials the server, which is bounded by ldapTimeout rather than ctx.
+func (s *LDAPStore) Ping(context.Context) error {
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
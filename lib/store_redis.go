@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	redisKeyPrefix = "user:"
+	redisTimeout   = 3 * time.Second
+)
+
+// RedisStore is an AuthStore reading the password of a user from the key
+// `user:<name>`. When Channel is set, found passwords are cached and any
+// message published on the channel drops the cache.
+type RedisStore struct {
+	Client  *redis.Client
+	Channel string
+	Cache   map[string]string
+	Lock    sync.Mutex
+
+	dummy backendDummy
+}
+
+func NewRedisStore(addr, password string, db int, channel string) *RedisStore {
+	return &RedisStore{
+		Client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       db,
+		}),
+		Channel: channel,
+		Cache:   make(map[string]string),
+	}
+}
+
+func (s *RedisStore) lookup(ctx context.Context, user string) (string, bool, error) {
+	if s.Channel != "" {
+		s.Lock.Lock()
+		stored, ok := s.Cache[user]
+		s.Lock.Unlock()
+		if ok {
+			return stored, true, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	stored, err := s.Client.Get(ctx, redisKeyPrefix+user).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if s.Channel != "" {
+		s.Lock.Lock()
+		s.Cache[user] = stored
+		s.Lock.Unlock()
+	}
+	return stored, true, nil
+}
+
+func (s *RedisStore) Verify(user, password string) (bool, error) {
+	return s.VerifyContext(context.Background(), user, password)
+}
+
+func (s *RedisStore) VerifyContext(ctx context.Context, user, password string) (bool, error) {
+	stored, ok, err := s.lookup(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		stored = s.dummy.get()
+	} else {
+		s.dummy.seen(stored)
+	}
+	return verifyPassword(stored, password) && ok, nil
+}
+
+func (s *RedisStore) Reload() error {
+	s.Lock.Lock()
+	s.Cache = make(map[string]string)
+	s.Lock.Unlock()
+	return s.Ping(context.Background())
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	return s.Client.Ping(ctx).Err()
+}
+
+// Close closes the connections to the server.
+func (s *RedisStore) Close() error {
+	return s.Client.Close()
+}
+
+// Subscribe pushes to refreshChan for every message published on Channel
+// until ctx is done.
+func (s *RedisStore) Subscribe(ctx context.Context, refreshChan chan struct{}, logger *slog.Logger) {
+	pubsub := s.Client.Subscribe(ctx, s.Channel)
+	defer pubsub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			logger.Info("receive redis invalidation, refresh cache...", "channel", msg.Channel)
+			requestRefresh(refreshChan, logger)
+		}
+	}
+}
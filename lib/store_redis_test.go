@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks enough RESP for RedisStore: GET, PING and SUBSCRIBE.
+type fakeRedis struct {
+	ln          net.Listener
+	lock        sync.Mutex
+	values      map[string]string
+	conns       []net.Conn
+	subscribers []net.Conn
+}
+
+func newFakeRedis(t *testing.T, values map[string]string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	r := &fakeRedis{ln: ln, values: values}
+	t.Cleanup(func() {
+		_ = ln.Close()
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		for _, conn := range r.conns {
+			_ = conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			r.conns = append(r.conns, conn)
+			r.lock.Unlock()
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) set(key, value string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.values[key] = value
+}
+
+func (r *fakeRedis) publish(channel, message string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, conn := range r.subscribers {
+		fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(message), message)
+	}
+	return len(r.subscribers)
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		r.lock.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			io.WriteString(conn, "+PONG\r\n")
+		case "GET":
+			if value, ok := r.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				io.WriteString(conn, "$-1\r\n")
+			}
+		case "SUBSCRIBE":
+			r.subscribers = append(r.subscribers, conn)
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		r.lock.Unlock()
+	}
+}
+
+// readRESPCommand reads an array of bulk strings.
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid array `%s`", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk string `%s`", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	r := newFakeRedis(t, map[string]string{"user:alice": "x", "user:bob": "y"})
+	s := NewRedisStore(r.ln.Addr().String(), "", 0, "")
+	defer s.Close()
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "x", true},
+		{"alice", "y", false},
+		{"bob", "y", true},
+		{"carol", "x", false},
+	}
+	for _, tt := range tests {
+		ok, err := s.Verify(tt.user, tt.password)
+		if err != nil || ok != tt.want {
+			t.Errorf("Verify(%s, %s) = %v, %v, want %v", tt.user, tt.password, ok, err, tt.want)
+		}
+	}
+	// without a channel nothing is cached
+	r.set("user:alice", "x2")
+	if ok, _ := s.Verify("alice", "x2"); !ok {
+		t.Error("Verify(alice, x2) = false after the key changed, want true")
+	}
+
+	_ = r.ln.Close()
+	_ = s.Close()
+	closed := NewRedisStore(r.ln.Addr().String(), "", 0, "")
+	defer closed.Close()
+	if _, err := closed.Verify("alice", "x2"); err == nil {
+		t.Error("Verify() without a server error = nil, want error")
+	}
+}
+
+func TestRedisStoreChannel(t *testing.T) {
+	r := newFakeRedis(t, map[string]string{"user:alice": "x"})
+	s := NewRedisStore(r.ln.Addr().String(), "", 0, "invalidate")
+	defer s.Close()
+	if ok, err := s.Verify("alice", "x"); err != nil || !ok {
+		t.Fatalf("Verify(alice, x) = %v, %v, want true", ok, err)
+	}
+	r.set("user:alice", "x2")
+	if ok, _ := s.Verify("alice", "x"); !ok {
+		t.Error("Verify(alice, x) = false, want the cached password")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	refreshChan := make(chan struct{}, 1)
+	go s.Subscribe(ctx, refreshChan, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	deadline := time.Now().Add(5 * time.Second)
+	for r.publish("invalidate", "alice") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscribe() did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-refreshChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload requested after a message")
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if ok, _ := s.Verify("alice", "x2"); !ok {
+		t.Error("Verify(alice, x2) = false after Reload(), want true")
+	}
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	_ "modernc.org/sqlite"
+	"sync"
+	"time"
+)
+
+const sqliteCacheTTL = time.Minute
+
+// SQLiteStore is an AuthStore reading credentials on demand from a SQLite
+// table `users(name TEXT PRIMARY KEY, password TEXT)`. Found passwords are
+// cached and the cache is dropped every sqliteCacheTTL or on Reload.
+type SQLiteStore struct {
+	DB        *sql.DB
+	Cache     map[string]string
+	CacheTime time.Time
+	Lock      sync.Mutex
+
+	dummy backendDummy
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (name TEXT PRIMARY KEY, password TEXT NOT NULL)`)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{
+		DB:        db,
+		Cache:     make(map[string]string),
+		CacheTime: time.Now(),
+	}, nil
+}
+
+func (s *SQLiteStore) lookup(ctx context.Context, user string) (string, bool, error) {
+	s.Lock.Lock()
+	if time.Since(s.CacheTime) > sqliteCacheTTL {
+		s.Cache = make(map[string]string)
+		s.CacheTime = time.Now()
+	}
+	stored, ok := s.Cache[user]
+	s.Lock.Unlock()
+	if ok {
+		return stored, true, nil
+	}
+	err := s.DB.QueryRowContext(ctx, `SELECT password FROM users WHERE name = ?`, user).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	s.Lock.Lock()
+	s.Cache[user] = stored
+	s.Lock.Unlock()
+	return stored, true, nil
+}
+
+func (s *SQLiteStore) Verify(user, password string) (bool, error) {
+	return s.VerifyContext(context.Background(), user, password)
+}
+
+func (s *SQLiteStore) VerifyContext(ctx context.Context, user, password string) (bool, error) {
+	stored, ok, err := s.lookup(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		stored = s.dummy.get()
+	} else {
+		s.dummy.seen(stored)
+	}
+	return verifyPassword(stored, password) && ok, nil
+}
+
+func (s *SQLiteStore) Reload() error {
+	s.Lock.Lock()
+	s.Cache = make(map[string]string)
+	s.CacheTime = time.Now()
+	s.Lock.Unlock()
+	return s.DB.Ping()
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.DB.PingContext(ctx)
+}
+
+// Close closes the database.
+func (s *SQLiteStore) Close() error {
+	return s.DB.Close()
+}
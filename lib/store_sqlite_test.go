@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	hash, err := HashPassword("y", "bcrypt", 4)
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	if _, err := s.DB.Exec(`INSERT INTO users (name, password) VALUES (?, ?), (?, ?)`, "alice", "x", "bob", hash); err != nil {
+		t.Fatalf("insert error = %v", err)
+	}
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "x", true},
+		{"alice", "y", false},
+		{"bob", "y", true},
+		{"bob", "x", false},
+		{"carol", "x", false},
+		{"carol", "", false},
+	}
+	for _, tt := range tests {
+		// twice, the second time from the cache
+		for i := 0; i < 2; i++ {
+			ok, err := s.Verify(tt.user, tt.password)
+			if err != nil || ok != tt.want {
+				t.Errorf("Verify(%s, %s) #%d = %v, %v, want %v", tt.user, tt.password, i, ok, err, tt.want)
+			}
+		}
+	}
+
+	if _, err := s.DB.Exec(`UPDATE users SET password = ? WHERE name = ?`, "x2", "alice"); err != nil {
+		t.Fatalf("update error = %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if ok, _ := s.Verify("alice", "x2"); !ok {
+		t.Error("Verify(alice, x2) = false after Reload(), want true")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := s.Verify("carol", "x"); err == nil {
+		t.Error("Verify() on a closed database error = nil, want error")
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() on a closed database error = nil, want error")
+	}
+}
@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeAuthFiles(t *testing.T) {
+	first := writeTestFile(t, "first", "alice=x\nbob=y\n")
+	second := writeTestFile(t, "second.json", `{"bob": "y2", "carol": "z"}`)
+	AuthMap, duplicates, err := readAuthFiles([]string{first, second}, "")
+	if err != nil {
+		t.Fatalf("readAuthFiles() error = %v", err)
+	}
+	want := map[string][]string{"alice": {"x"}, "bob": {"y2"}, "carol": {"z"}}
+	if !reflect.DeepEqual(AuthMap, want) {
+		t.Errorf("readAuthFiles() = %v, want %v", AuthMap, want)
+	}
+	if !reflect.DeepEqual(duplicates, []string{"bob"}) {
+		t.Errorf("duplicates = %v, want [bob]", duplicates)
+	}
+	AuthMap, _, err = readAuthFiles([]string{second, first}, "")
+	if err != nil {
+		t.Fatalf("readAuthFiles() error = %v", err)
+	}
+	if !reflect.DeepEqual(AuthMap["bob"], []string{"y"}) {
+		t.Errorf("bob = %v, want the last file to win", AuthMap["bob"])
+	}
+	if got := splitAuthFiles(" a, ,b ,"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("splitAuthFiles() = %v, want [a b]", got)
+	}
+}
+
+func TestMapKeepsUsersOnEmptyReload(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{name: "empty file", file: "tokens", data: ""},
+		{name: "truncated file", file: "tokens", data: "alice"},
+		{name: "comments only", file: "tokens", data: "# all gone\n"},
+		{name: "corrupt json", file: "tokens.json", data: `{"alice": `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeTestFile(t, tt.file, `{"alice": "x"}`)
+			m := &Map{AuthFiles: []string{filename}}
+			if err := m.Reload(); err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			if err := os.WriteFile(filename, []byte(tt.data), 0600); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			if err := m.Reload(); err == nil {
+				t.Error("Reload() error = nil, want error")
+			}
+			if ok, _ := m.Verify("alice", "x"); !ok {
+				t.Error("Verify(alice) = false, want the previous users kept")
+			}
+		})
+	}
+}
+
+func TestMapAllowEmptyReload(t *testing.T) {
+	m := &Map{AuthData: []byte("alice=x\n"), AllowEmpty: true}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	m.AuthData = []byte("\n")
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() with AllowEmpty error = %v", err)
+	}
+	if m.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", m.Len())
+	}
+	m = &Map{AuthData: []byte("\n")}
+	if err := m.Reload(); err != nil {
+		t.Errorf("first Reload() of an empty file error = %v, want nil", err)
+	}
+	m.AuthData = []byte("alice=x\n")
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	m.AuthData = []byte("\n")
+	if err := m.Reload(); !errors.Is(err, errEmptyAuthData) {
+		t.Errorf("Reload() error = %v, want %v", err, errEmptyAuthData)
+	}
+}
+
+func TestCaseInsensitiveUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		ciUser  bool
+		user    string
+		success bool
+	}{
+		{name: "exact name", user: "Alice", success: true},
+		{name: "other case", user: "alice"},
+		{name: "exact name case insensitive", ciUser: true, user: "Alice", success: true},
+		{name: "other case case insensitive", ciUser: true, user: "ALICE", success: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{AuthData: "Alice=x\n", CaseInsensitiveUser: tt.ciUser})
+			resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"`+tt.user+`","metas":{"password":"x"}}`))
+			if resp.Reject == tt.success {
+				t.Errorf("login of %s reject = %v (%s), want success %v", tt.user, resp.Reject, resp.RejectReason, tt.success)
+			}
+		})
+	}
+}
+
+func TestMapLowerUsersCollision(t *testing.T) {
+	var logs bytes.Buffer
+	m := &Map{
+		AuthData:   []byte("Alice=x;ports=80\nALICE=y\n"),
+		LowerUsers: true,
+		Logger:     slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	// the last user in sort order wins, ALICE before Alice
+	if ok, _ := m.Verify("alice", "x"); !ok {
+		t.Error("Verify(alice, x) = false, want true")
+	}
+	if ok, _ := m.Verify("alice", "y"); ok {
+		t.Error("Verify(alice, y) = true, want the colliding user dropped")
+	}
+	if m.Policy("alice") == nil {
+		t.Error("policy of the winning user dropped")
+	}
+	if !strings.Contains(logs.String(), "users collide after lowercasing") {
+		t.Errorf("no collision warning logged:\n%s", logs.String())
+	}
+}
+
+func TestMapMultiplePasswords(t *testing.T) {
+	m := &Map{AuthData: []byte("alice=old\nalice=new\nbob=y\n")}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"alice", "old", true},
+		{"alice", "new", true},
+		{"alice", "other", false},
+		{"alice", "y", false},
+		{"bob", "y", true},
+		{"bob", "old", false},
+	}
+	for _, tt := range tests {
+		if ok, _ := m.Verify(tt.user, tt.password); ok != tt.ok {
+			t.Errorf("Verify(%s, %s) = %v, want %v", tt.user, tt.password, ok, tt.ok)
+		}
+	}
+}
+
+func TestMapUserPatterns(t *testing.T) {
+	m := &Map{AuthData: []byte("ci-*=shared\nci-special=own\nci-prod-*=prod;ports=443\nbuild-?=b\n")}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		ok       bool
+	}{
+		{name: "pattern", user: "ci-runner1", password: "shared", ok: true},
+		{name: "exact entry wins", user: "ci-special", password: "own", ok: true},
+		{name: "exact entry ignores the pattern", user: "ci-special", password: "shared"},
+		{name: "longer pattern wins", user: "ci-prod-1", password: "prod", ok: true},
+		{name: "longer pattern ignores the shorter one", user: "ci-prod-1", password: "shared"},
+		{name: "single character", user: "build-1", password: "b", ok: true},
+		{name: "single character only", user: "build-12", password: "b"},
+		{name: "no match", user: "alice", password: "shared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok, _ := m.Verify(tt.user, tt.password); ok != tt.ok {
+				t.Errorf("Verify(%s, %s) = %v, want %v", tt.user, tt.password, ok, tt.ok)
+			}
+		})
+	}
+	if policy := m.Policy("ci-prod-1"); policy == nil || !policy.Ports.Contains(443) {
+		t.Errorf("Policy(ci-prod-1) = %v, want the policy of the pattern", policy)
+	}
+	if policy := m.Policy("ci-runner1"); policy != nil {
+		t.Errorf("Policy(ci-runner1) = %v, want none", policy)
+	}
+}
+
+func TestDiffUsers(t *testing.T) {
+	tests := []struct {
+		name                     string
+		old, new                 map[string][]string
+		added, removed, modified int
+	}{
+		{name: "first load", new: map[string][]string{"alice": {"x"}}, added: 1},
+		{name: "unchanged", old: map[string][]string{"alice": {"x"}}, new: map[string][]string{"alice": {"x"}}},
+		{
+			name:     "adds removes and modifications",
+			old:      map[string][]string{"alice": {"x"}, "bob": {"y"}, "carol": {"z"}, "dave": {"w"}},
+			new:      map[string][]string{"alice": {"x2"}, "bob": {"y", "y2"}, "dave": {"w"}, "erin": {"v"}, "frank": {"u"}},
+			added:    2,
+			removed:  1,
+			modified: 2,
+		},
+		{name: "everyone removed", old: map[string][]string{"alice": {"x"}, "bob": {"y"}}, new: map[string][]string{}, removed: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed, modified := diffUsers(tt.old, tt.new)
+			if added != tt.added || removed != tt.removed || modified != tt.modified {
+				t.Errorf("diffUsers() = +%d -%d ~%d, want +%d -%d ~%d", added, removed, modified, tt.added, tt.removed, tt.modified)
+			}
+		})
+	}
+}
+
+func TestMapReloadLogsDiff(t *testing.T) {
+	var logs bytes.Buffer
+	m := &Map{AuthData: []byte("alice=x\nbob=y\n"), Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if strings.Contains(logs.String(), "reload:") {
+		t.Errorf("first load logged a diff:\n%s", logs.String())
+	}
+	m.AuthData = []byte("alice=x2\ncarol=z\n")
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "reload: +1 -1 ~1 users") {
+		t.Errorf("reload diff not logged:\n%s", logs.String())
+	}
+}
+
+func TestAuthFileLoadErrors(t *testing.T) {
+	good := writeTestFile(t, "good", "alice=x\n")
+	bad := writeTestFile(t, "bad.json", "{not json")
+	authFile := good + "," + bad
+	_, err := NewServer(Config{AuthFile: authFile, BindAddress: "127.0.0.1:0", PasswordMetaKey: "password"})
+	if err == nil {
+		t.Fatal("NewServer() with a failed auth file error = nil, want error")
+	}
+	s := newTestServer(t, Config{AuthFile: authFile, SkipFailedAuthFiles: true})
+	ok, err := s.store.Verify("alice", "x")
+	if err != nil || !ok {
+		t.Errorf("Verify(alice) = %v, %v, want true", ok, err)
+	}
+}
+
+func TestMapSkipFailedFilesKeepsPreviousEntries(t *testing.T) {
+	first := writeTestFile(t, "first", "alice=x\n")
+	second := writeTestFile(t, "second", "bob=y\n")
+	m := &Map{AuthFiles: []string{first, second}, SkipFailedFiles: true}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if err := os.Remove(second); err != nil {
+		t.Fatalf("remove error = %v", err)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() with a missing file error = %v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if ok, _ := m.Verify(user, map[string]string{"alice": "x", "bob": "y"}[user]); !ok {
+			t.Errorf("Verify(%s) = false, want the previous entries kept", user)
+		}
+	}
+	if err := os.Remove(first); err != nil {
+		t.Fatalf("remove error = %v", err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Error("Reload() with every file missing error = nil, want error")
+	}
+}
+
+func TestMapPromote(t *testing.T) {
+	live := writeTestFile(t, "live", "alice=x\n")
+	staged := writeTestFile(t, "staged", "alice=y\nbob=z\n")
+	m := &Map{AuthFiles: []string{live}, StagedFiles: []string{staged}}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if err := m.Promote(); err != nil {
+		t.Fatalf("Promote() error = %v", err)
+	}
+	if !reflect.DeepEqual(m.AuthFiles, []string{staged}) || !reflect.DeepEqual(m.StagedFiles, []string{live}) {
+		t.Errorf("files = %v, staged %v, want swapped", m.AuthFiles, m.StagedFiles)
+	}
+	for _, tt := range []struct {
+		user, password string
+		want           bool
+	}{{"alice", "y", true}, {"alice", "x", false}, {"bob", "z", true}} {
+		if ok, _ := m.Verify(tt.user, tt.password); ok != tt.want {
+			t.Errorf("Verify(%s, %s) after Promote() = %v, want %v", tt.user, tt.password, ok, tt.want)
+		}
+	}
+	// a second Promote rolls back
+	if err := m.Promote(); err != nil {
+		t.Fatalf("second Promote() error = %v", err)
+	}
+	if ok, _ := m.Verify("alice", "x"); !ok {
+		t.Error("Verify(alice, x) after the rollback = false, want true")
+	}
+
+	// a staged file which does not load changes nothing
+	if err := os.Remove(staged); err != nil {
+		t.Fatalf("remove error = %v", err)
+	}
+	if err := m.Promote(); err == nil {
+		t.Error("Promote() of a missing staged file error = nil, want error")
+	}
+	if !reflect.DeepEqual(m.AuthFiles, []string{live}) {
+		t.Errorf("files = %v after a failed Promote(), want %v", m.AuthFiles, []string{live})
+	}
+	if ok, _ := m.Verify("alice", "x"); !ok {
+		t.Error("Verify(alice, x) after a failed Promote() = false, want true")
+	}
+
+	if err := (&Map{AuthFiles: []string{live}}).Promote(); !errors.Is(err, errNoStagedFiles) {
+		t.Errorf("Promote() without staged files error = %v, want %v", err, errNoStagedFiles)
+	}
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// otpMetaKey is the frpc meta holding the one-time password of users with a
+// TOTP secret.
+const otpMetaKey = "otp"
+
+// TOTP parameters of RFC 6238 as used by the common authenticator apps.
+// Codes of totpSkew periods before and after the current one are accepted
+// too, to allow for clock drift.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+// parseTOTPSecret decodes a base32 TOTP secret, with or without padding.
+func parseTOTPSecret(s string) ([]byte, error) {
+	value := strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("invalid totp secret")
+	}
+	return secret, nil
+}
+
+// totpCode returns the HOTP code of RFC 4226 for counter.
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// verifyTOTP reports whether code is valid for secret at t.
+func verifyTOTP(secret []byte, code string, t time.Time) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return false
+	}
+	counter := t.Unix() / totpPeriod
+	valid := false
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if counter+i < 0 {
+			continue
+		}
+		// every window is checked so that the timing does not tell which
+		// one matched
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, uint64(counter+i))), []byte(code)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
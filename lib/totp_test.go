@@ -0,0 +1,116 @@
+package lib
+
+import (
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 secret of the RFC 6238 test vectors, base32
+// encoded as an authenticator app would take it.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	secret, err := parseTOTPSecret(rfc6238Secret)
+	if err != nil {
+		t.Fatalf("parseTOTPSecret() error = %v", err)
+	}
+	// the 8 digit codes of RFC 6238 appendix B truncated to 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if code := totpCode(secret, uint64(tt.unix/totpPeriod)); code != tt.code {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, code, tt.code)
+		}
+		if !verifyTOTP(secret, tt.code, time.Unix(tt.unix, 0)) {
+			t.Errorf("verifyTOTP(%s, T=%d) = false, want true", tt.code, tt.unix)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	secret, err := parseTOTPSecret(rfc6238Secret)
+	if err != nil {
+		t.Fatalf("parseTOTPSecret() error = %v", err)
+	}
+	issued := time.Unix(1111111109, 0)
+	tests := []struct {
+		name  string
+		at    time.Time
+		valid bool
+	}{
+		{name: "same period", at: issued, valid: true},
+		{name: "previous period", at: issued.Add(totpPeriod * time.Second), valid: true},
+		{name: "next period", at: issued.Add(-totpPeriod * time.Second), valid: true},
+		{name: "expired", at: issued.Add(3 * totpPeriod * time.Second), valid: false},
+		{name: "too early", at: issued.Add(-3 * totpPeriod * time.Second), valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid := verifyTOTP(secret, "081804", tt.at); valid != tt.valid {
+				t.Errorf("verifyTOTP() = %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+	for _, code := range []string{"", "08180", "0818040", "081805"} {
+		if verifyTOTP(secret, code, issued) {
+			t.Errorf("verifyTOTP(%q) = true, want false", code)
+		}
+	}
+}
+
+func TestParseTOTPSecret(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: rfc6238Secret},
+		{value: "gezd gnbv gy3t qojq gezd gnbv gy3t qojq"},
+		{value: "JBSWY3DPEHPK3PXP"},
+		{value: "JBSWY3DPEHPK3PXP===="},
+		{value: "", wantErr: true},
+		{value: "not base32!", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := parseTOTPSecret(tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("parseTOTPSecret(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoginOTP(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return time.Unix(1111111109, 0) }
+
+	s := newTestServer(t, Config{AuthData: "alice=x;totp=" + rfc6238Secret + "\nbob=y\n"})
+	tests := []struct {
+		name   string
+		user   string
+		metas  string
+		reject bool
+	}{
+		{name: "valid", user: "alice", metas: `{"password":"x","otp":"081804"}`},
+		{name: "invalid", user: "alice", metas: `{"password":"x","otp":"000000"}`, reject: true},
+		{name: "expired", user: "alice", metas: `{"password":"x","otp":"287082"}`, reject: true},
+		{name: "missing", user: "alice", metas: `{"password":"x"}`, reject: true},
+		{name: "wrong password", user: "alice", metas: `{"password":"y","otp":"081804"}`, reject: true},
+		{name: "no secret", user: "bob", metas: `{"password":"y"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := decodeResponse(t, postPlugin(t, s, plugin.OpLogin, `{"user":"`+tt.user+`","metas":`+tt.metas+`}`))
+			if resp.Reject != tt.reject {
+				t.Errorf("reject = %v (%s), want %v", resp.Reject, resp.RejectReason, tt.reject)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "frp-multiuser"
+
+// newTracerProvider returns the tracer provider for the config: the one set
+// in Config.TracerProvider, an OTLP exporter configured by the standard
+// OTEL_EXPORTER_OTLP_* environment variables when OTel is set, or a no-op
+// one. The returned shutdown flushes the pending spans.
+func newTracerProvider(cfg *Config) (trace.TracerProvider, func(context.Context) error, error) {
+	noShutdown := func(context.Context) error { return nil }
+	if cfg.TracerProvider != nil {
+		return cfg.TracerProvider, noShutdown, nil
+	}
+	if !cfg.OTel {
+		return trace.NewNoopTracerProvider(), noShutdown, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(tracerName),
+		semconv.ServiceVersion(Version),
+	))
+	if err != nil {
+		return nil, nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	return provider, provider.Shutdown, nil
+}
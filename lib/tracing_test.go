@@ -0,0 +1,72 @@
+package lib
+
+import (
+	plugin "github.com/fatedier/frp/pkg/plugin/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+// spanAttributes returns the string attributes of a span.
+func spanAttributes(span sdktrace.ReadOnlySpan) map[string]string {
+	attributes := make(map[string]string)
+	for _, kv := range span.Attributes() {
+		if kv.Value.Type() == attribute.STRING {
+			attributes[string(kv.Key)] = kv.Value.AsString()
+		}
+	}
+	return attributes
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	s := newTestServer(t, Config{AuthData: "alice=x", TracerProvider: provider})
+	tests := []struct {
+		name     string
+		password string
+		decision string
+	}{
+		{name: "accepted", password: "x", decision: "accept"},
+		{name: "rejected", password: "y", decision: "reject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.Reset()
+			postPlugin(t, s, plugin.OpLogin, `{"user":"alice","metas":{"password":"`+tt.password+`"}}`)
+			spans := exporter.GetSpans().Snapshots()
+			if len(spans) != 2 {
+				t.Fatalf("%d spans, want verify and the request", len(spans))
+			}
+			// the child ends first
+			verify, request := spans[0], spans[1]
+			if verify.Name() != "verify" || request.Name() != "plugin Login" {
+				t.Fatalf("spans = %s, %s, want verify, plugin Login", verify.Name(), request.Name())
+			}
+			if verify.Parent().SpanID() != request.SpanContext().SpanID() {
+				t.Error("verify span is not a child of the request span")
+			}
+			if got := spanAttributes(verify)["frp.user"]; got != "alice" {
+				t.Errorf("verify frp.user = %q, want alice", got)
+			}
+			attributes := spanAttributes(request)
+			for key, want := range map[string]string{"frp.op": "Login", "frp.user": "alice", "frp.decision": tt.decision} {
+				if attributes[key] != want {
+					t.Errorf("request %s = %q, want %q", key, attributes[key], want)
+				}
+			}
+			if request.Status().Code == codes.Error {
+				t.Errorf("request status = %v, want no error", request.Status())
+			}
+		})
+	}
+
+	exporter.Reset()
+	postPlugin(t, s, plugin.OpLogin, `{"user":1}`)
+	spans := exporter.GetSpans().Snapshots()
+	if len(spans) != 1 || spans[0].Status().Code != codes.Error || spanAttributes(spans[0])["frp.decision"] != "error" {
+		t.Errorf("malformed request spans = %v, want one span with an error status", spans)
+	}
+}
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ValidationIssue is a problem found in an auth file. Line is zero when the
+// problem is not tied to a line, e.g. for JSON and YAML files.
+type ValidationIssue struct {
+	Line    int
+	Error   bool
+	Message string
+}
+
+func (i ValidationIssue) String() string {
+	level := "warning"
+	if i.Error {
+		level = "error"
+	}
+	if i.Line == 0 {
+		return fmt.Sprintf("%s: %s", level, i.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", i.Line, level, i.Message)
+}
+
+// ValidationResult is the outcome of validating one auth file.
+type ValidationResult struct {
+	File   string
+	Users  int
+	Issues []ValidationIssue
+}
+
+// HasErrors reports whether any issue is an error rather than a warning.
+func (r *ValidationResult) HasErrors() bool {
+	for _, issue := range r.Issues {
+		if issue.Error {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAuthFiles checks the comma separated auth files without loading
+// them into a server. Auth URLs are fetched with the bearer token if set.
+func ValidateAuthFiles(authFile, token string) []ValidationResult {
+	var results []ValidationResult
+	for _, filename := range splitAuthFiles(authFile) {
+		results = append(results, validateAuthSource(filename, token))
+	}
+	return results
+}
+
+// ValidateAuthFile checks an auth file. Malformed lines and invalid inline
+// policies are errors; empty passwords, which the server skips, and users
+// listed more than once are warnings.
+func ValidateAuthFile(filename string) ValidationResult {
+	return validateAuthSource(filename, "")
+}
+
+func validateAuthSource(filename, token string) ValidationResult {
+	AuthDataBytes, ext, err := readAuthSource(filename, token)
+	if err != nil {
+		return ValidationResult{File: redactAuthFile(filename), Issues: []ValidationIssue{{Error: true, Message: err.Error()}}}
+	}
+	return validateAuthData(redactAuthFile(filename), ext, AuthDataBytes)
+}
+
+// ValidatePolicyFile checks a policy file the way the server loads it.
+func ValidatePolicyFile(filename string) ValidationResult {
+	result := ValidationResult{File: filename}
+	PolicyMap, err := readPolicyFile(filename)
+	if err != nil {
+		result.Issues = append(result.Issues, ValidationIssue{Error: true, Message: err.Error()})
+		return result
+	}
+	result.Users = len(PolicyMap)
+	return result
+}
+
+// ValidateAuthData checks credentials given as data rather than a file,
+// e.g. through -auth_env. name is only used in the result.
+func ValidateAuthData(name string, AuthDataBytes []byte) ValidationResult {
+	return validateAuthData(name, "", AuthDataBytes)
+}
+
+func validateAuthData(name, ext string, AuthDataBytes []byte) ValidationResult {
+	result := ValidationResult{File: name}
+	if format := authFileFormat(ext, AuthDataBytes); format != authFormatKV {
+		var AuthMap map[string][]string
+		var err error
+		if format == authFormatYAML {
+			AuthMap, err = parseAuthYAML(AuthDataBytes)
+		} else {
+			AuthMap, err = parseAuthJSON(AuthDataBytes)
+		}
+		if err != nil {
+			result.Issues = append(result.Issues, ValidationIssue{Error: true, Message: err.Error()})
+			return result
+		}
+		for user, entries := range AuthMap {
+			for _, entry := range entries {
+				result.Issues = append(result.Issues, validateAuthEntry(0, user, entry)...)
+			}
+		}
+		result.Users = len(AuthMap)
+		return result
+	}
+	AuthData := strings.ReplaceAll(string(AuthDataBytes), "\r\n", "\n")
+	users := make(map[string]int)
+	for i, row := range strings.Split(AuthData, "\n") {
+		line := i + 1
+		row = strings.TrimSpace(row)
+		if row == "" || strings.HasPrefix(row, "#") {
+			continue
+		}
+		kvs := strings.SplitN(row, "=", 2)
+		if len(kvs) != 2 {
+			result.Issues = append(result.Issues, ValidationIssue{Line: line, Error: true, Message: "missing `=`"})
+			continue
+		}
+		user, entry := strings.TrimSpace(kvs[0]), strings.TrimSpace(kvs[1])
+		if user == "" {
+			result.Issues = append(result.Issues, ValidationIssue{Line: line, Error: true, Message: "empty user"})
+			continue
+		}
+		if entry == "" {
+			result.Issues = append(result.Issues, ValidationIssue{Line: line, Message: fmt.Sprintf("user `%s` has an empty password and is skipped", user)})
+			continue
+		}
+		if first, ok := users[user]; ok {
+			result.Issues = append(result.Issues, ValidationIssue{Line: line, Message: fmt.Sprintf("user `%s` is already listed at line %d, both passwords are accepted", user, first)})
+		} else {
+			users[user] = line
+		}
+		result.Issues = append(result.Issues, validateAuthEntry(line, user, entry)...)
+	}
+	result.Users = len(users)
+	return result
+}
+
+func validateAuthEntry(line int, user, entry string) []ValidationIssue {
+	if _, err := path.Match(user, ""); isUserPattern(user) && err != nil {
+		return []ValidationIssue{{Line: line, Error: true, Message: fmt.Sprintf("user `%s`: invalid pattern", user)}}
+	}
+	password, _, err := parseAuthEntry(entry)
+	if err != nil {
+		return []ValidationIssue{{Line: line, Error: true, Message: fmt.Sprintf("user `%s`: %v", user, err)}}
+	}
+	if password == "" {
+		return []ValidationIssue{{Line: line, Message: fmt.Sprintf("user `%s` has an empty password and is skipped", user)}}
+	}
+	return nil
+}
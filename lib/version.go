@@ -0,0 +1,10 @@
+package lib
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X frp-multiuser/lib.Version=v1.2.0 -X frp-multiuser/lib.Commit=$(git rev-parse --short HEAD) -X frp-multiuser/lib.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
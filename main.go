@@ -1,19 +1,179 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"frp-multiuser/lib"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	BindAddress := flag.String("addr", net.JoinHostPort("::", "7003"), "bind address")
-	AuthFile := flag.String("auth_file", "./tokens", "auth token file")
-	Inotify := flag.Bool("inotify", false, "use inotify to watch auth file")
+	cfg := lib.Config{}
+	ConfigFile := flag.String("config", "", "yaml or json config file, flags given on the command line take precedence")
+	PrintVersion := flag.Bool("version", false, "print the version and exit")
+	AuthEnv := flag.String("auth_env", "", "environment variable holding the credentials in the auth file format, used instead of the auth file")
+	HashPW := flag.Bool("hashpw", false, "read a password from stdin, print its hash for the auth file and exit")
+	HashScheme := flag.String("hash_scheme", "bcrypt", "hash scheme used by -hashpw, bcrypt or argon2id")
+	HashCost := flag.Int("hash_cost", 10, "bcrypt cost used by -hashpw")
+	Validate := flag.Bool("validate", false, "check the auth files and exit, non-zero if errors are found")
+	flag.StringVar(&cfg.BindAddress, "addr", net.JoinHostPort("::", "7003"), "bind address, or unix:/path for a unix socket")
+	flag.StringVar(&cfg.Network, "network", "tcp", "tcp, tcp4 or tcp6, the network addr and admin_addr are bound on, -addr must match it")
+	flag.StringVar(&cfg.AuthFile, "auth_file", "./tokens", "auth token file, or a comma separated list of files merged in order")
+	flag.StringVar(&cfg.StagedAuthFile, "staged_auth_file", "", "auth file swapped with auth_file by POST /promote on the admin api")
+	flag.StringVar(&cfg.DBPath, "db", "", "sqlite database with a users(name, password) table, used instead of the auth file")
+	flag.StringVar(&cfg.RedisAddr, "redis_addr", "", "redis address, reads passwords from user:<name> keys instead of the auth file")
+	flag.StringVar(&cfg.RedisPassword, "redis_password", "", "redis password")
+	flag.IntVar(&cfg.RedisDB, "redis_db", 0, "redis database")
+	flag.StringVar(&cfg.RedisChannel, "redis_channel", "", "redis pub/sub channel, cache passwords and drop the cache on any message")
+	flag.StringVar(&cfg.LDAPURL, "ldap_url", "", "ldap url, verifies users by binding to ldap instead of the auth file")
+	flag.StringVar(&cfg.LDAPBindDN, "ldap_bind_dn", "", "ldap bind dn template, %s is replaced with the user")
+	flag.StringVar(&cfg.LDAPBaseDN, "ldap_base_dn", "", "ldap base dn, binds as uid=<user>,<base dn> when no template is set")
+	flag.DurationVar(&cfg.BackendTimeout, "backend_timeout", 5*time.Second, "timeout of each sqlite/redis/ldap verification")
+	flag.DurationVar(&cfg.CacheTTL, "cache_ttl", 0, "cache sqlite/redis/ldap verifications for this long, failed ones for a tenth of it")
+	flag.StringVar(&cfg.PolicyFile, "policy_file", "", "optional yaml policy file keyed by user")
+	flag.StringVar(&cfg.PasswordMetaKey, "password_key", lib.DefaultPasswordMetaKey, "frpc meta key holding the password")
+	flag.BoolVar(&cfg.Inotify, "inotify", false, "use inotify to watch auth file")
+	flag.StringVar(&cfg.AuthURLToken, "auth_url_token", "", "bearer token sent when fetching an auth file which is an http(s) url")
+	flag.DurationVar(&cfg.AuthURLInterval, "auth_url_interval", 0, "fetch auth files which are http(s) urls again at this interval, 0 disables it")
+	flag.DurationVar(&cfg.PollInterval, "poll_interval", 0, "check the auth file for changes at this interval, 0 disables polling")
+	flag.StringVar(&cfg.TLSCertFile, "tls_cert", "", "tls certificate file")
+	flag.StringVar(&cfg.TLSKeyFile, "tls_key", "", "tls key file")
+	flag.StringVar(&cfg.AuthToken, "endpoint_token", "", "bearer token required on plugin requests")
+	flag.StringVar(&cfg.AdminAddr, "admin_addr", "", "admin api bind address, disabled when empty")
+	flag.StringVar(&cfg.AdminToken, "admin_token", "", "bearer token required on admin api requests")
+	flag.StringVar(&cfg.AllowCIDRs, "allow_cidrs", "", "comma separated cidrs plugin requests are accepted from, all when empty")
+	flag.StringVar(&cfg.DenyCIDRs, "deny_cidrs", "", "comma separated cidrs plugin requests are refused from")
+	flag.BoolVar(&cfg.Metrics, "metrics", false, "expose prometheus metrics at /metrics")
+	flag.BoolVar(&cfg.Gzip, "gzip", false, "gzip responses for clients accepting it")
+	flag.BoolVar(&cfg.VersionEndpoint, "version_endpoint", true, "expose the build information at /version")
+	flag.StringVar(&cfg.LogFormat, "log_format", "text", "log format, text or json")
+	flag.BoolVar(&cfg.AccessLog, "access_log", false, "log every http request with its status and duration")
+	flag.StringVar(&cfg.LogLevel, "log_level", "info", "log level, debug, info, warn or error")
+	flag.BoolVar(&cfg.OTel, "otel", false, "export traces over otlp, configured by the OTEL_EXPORTER_OTLP_* environment variables")
+	flag.StringVar(&cfg.TrustedProxies, "trusted_proxies", "", "comma separated cidrs of the proxies X-Forwarded-For is taken from")
+	flag.BoolVar(&cfg.TrustForwarded, "trust_forwarded", false, "take the client ip from X-Real-IP of requests from -trusted_proxies")
+	flag.DurationVar(&cfg.ReloadDebounce, "reload_debounce", 200*time.Millisecond, "coalesce auth file reloads within this window")
+	flag.StringVar(&cfg.MaintenanceFile, "maintenance_file", "", "reject every login while this file exists")
+	flag.StringVar(&cfg.MaintenanceMessage, "maintenance_message", lib.DefaultMaintenanceMessage, "reject reason of logins in maintenance mode")
+	flag.StringVar(&cfg.ProxyNamePolicy, "proxy_name_policy", lib.ProxyNameEnforce, "proxies not prefixed with the user: enforce rejects them, warn logs them, off allows them")
+	flag.BoolVar(&cfg.StrictJSON, "strict_json", false, "reject requests with unknown json fields, for debugging")
+	flag.BoolVar(&cfg.StrictHTTP, "strict_http", false, "answer rejected requests with 403, frps expects 200 so keep it off behind frps")
+	flag.BoolVar(&cfg.GenericRejectMessage, "generic_reject", false, "reject unknown users and wrong passwords with the same generic message, recommended")
+	flag.BoolVar(&cfg.CheckUserConn, "check_user_conn", false, "check the credentials of the proxy owner on every NewUserConn")
+	flag.BoolVar(&cfg.CaseInsensitiveUser, "ci_user", false, "match user names case-insensitively")
+	flag.BoolVar(&cfg.AllowEmptyAuth, "allow_empty_auth", false, "allow a reload to leave no users")
+	flag.BoolVar(&cfg.SkipFailedAuthFiles, "skip_failed_auth_files", false, "load the other auth files when one of several can not be read, and log it")
+	flag.IntVar(&cfg.MaxProxies, "max_proxies", 0, "default limit of active proxies per user, 0 is unlimited")
+	flag.Float64Var(&cfg.RateLimit, "rate_limit", 0, "login attempts per second allowed per client ip, 0 is unlimited")
+	flag.IntVar(&cfg.RateBurst, "rate_burst", 5, "burst of login attempts allowed per client ip")
+	flag.Float64Var(&cfg.UserRateLimit, "user_rate_limit", 0, "login attempts per second allowed per user, 0 is unlimited")
+	flag.IntVar(&cfg.UserRateBurst, "user_rate_burst", 5, "burst of login attempts allowed per user")
+	flag.IntVar(&cfg.RateLimitStatus, "rate_limit_status", 429, "http status of throttled logins, sent with Retry-After")
+	flag.IntVar(&cfg.MaxConcurrent, "max_concurrent", 0, "maximum plugin requests handled at once, 0 is unlimited")
+	flag.Int64Var(&cfg.MaxBodyBytes, "max_body_bytes", 64<<10, "maximum plugin request body size in bytes")
+	flag.DurationVar(&cfg.ReadHeaderTimeout, "read_header_timeout", 5*time.Second, "http read header timeout")
+	flag.DurationVar(&cfg.ReadTimeout, "read_timeout", 10*time.Second, "http read timeout")
+	flag.DurationVar(&cfg.WriteTimeout, "write_timeout", 10*time.Second, "http write timeout")
+	flag.DurationVar(&cfg.IdleTimeout, "idle_timeout", 60*time.Second, "http keep-alive idle timeout")
+	flag.BoolVar(&cfg.DisableKeepAlives, "disable_keep_alives", false, "close every http connection after one request, for debugging")
+	flag.BoolVar(&cfg.H2C, "h2c", false, "accept http/2 over cleartext, http/2 is always negotiated with tls")
 	flag.Parse()
-	lib.NewServer(lib.Config{
-		BindAddress: *BindAddress,
-		AuthFile:    *AuthFile,
-		Inotify:     *Inotify,
-	})
+	if *PrintVersion {
+		fmt.Printf("frp-multiuser %s (commit %s, built %s)\n", lib.Version, lib.Commit, lib.BuildDate)
+		return
+	}
+	if *HashPW {
+		err := hashpw(*HashScheme, *HashCost)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "hash password error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	err := loadConfig(flag.CommandLine, os.Args[1:], *ConfigFile, &cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *AuthEnv != "" {
+		cfg.AuthData = os.Getenv(*AuthEnv)
+		if cfg.AuthData == "" {
+			fmt.Fprintf(os.Stderr, "environment variable %s is empty\n", *AuthEnv)
+			os.Exit(1)
+		}
+	}
+	if *Validate {
+		os.Exit(validate(cfg))
+	}
+	server, err := lib.NewServer(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create server error: %v\n", err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		hangupChan := make(chan os.Signal, 1)
+		signal.Notify(hangupChan, syscall.SIGHUP)
+		for range hangupChan {
+			server.Refresh()
+		}
+	}()
+	err = server.Run(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "run server error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads configFile, or the file named by the environment, into
+// cfg and applies the environment to the flags of fs, bound to cfg. Flags
+// given in args take precedence over environment variables, then the
+// config file, then the defaults.
+func loadConfig(fs *flag.FlagSet, args []string, configFile string, cfg *lib.Config) error {
+	if configFile == "" {
+		configFile = os.Getenv(envName("config"))
+	}
+	if configFile != "" {
+		err := lib.LoadConfigFile(configFile, cfg)
+		if err != nil {
+			return fmt.Errorf("load config file error: %v", err)
+		}
+	}
+	err := applyEnv(fs)
+	if err != nil {
+		return fmt.Errorf("read environment error: %v", err)
+	}
+	// parse again so that flags given on the command line win
+	return fs.Parse(args)
+}
+
+// validate prints the problems found in the auth files and returns the exit
+// code.
+func validate(cfg lib.Config) int {
+	code := 0
+	results := lib.ValidateAuthFiles(cfg.AuthFile, cfg.AuthURLToken)
+	results = append(results, lib.ValidateAuthFiles(cfg.StagedAuthFile, cfg.AuthURLToken)...)
+	if cfg.AuthData != "" {
+		results = []lib.ValidationResult{lib.ValidateAuthData("auth data", []byte(cfg.AuthData))}
+	}
+	if cfg.PolicyFile != "" {
+		results = append(results, lib.ValidatePolicyFile(cfg.PolicyFile))
+	}
+	for _, result := range results {
+		for _, issue := range result.Issues {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", result.File, issue)
+		}
+		if result.HasErrors() {
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: %d users\n", result.File, result.Users)
+	}
+	return code
 }